@@ -0,0 +1,42 @@
+package socks5
+
+import (
+	"encoding"
+	"strconv"
+	"strings"
+)
+
+var _ encoding.TextMarshaler = AuthMethod(0)
+var _ encoding.TextUnmarshaler = (*AuthMethod)(nil)
+
+var authMethodText = map[AuthMethod]string{
+	AuthMethodNone:   "none",
+	AuthGSSAPI:       "gssapi",
+	AuthUserPass:     "userpass",
+	AuthHMAC:         "hmac",
+	AuthToken:        "token",
+	AuthNoAcceptable: "noacceptable",
+}
+
+func (am AuthMethod) String() string {
+	if s, ok := authMethodText[am]; ok {
+		return s
+	}
+	return "method(" + strconv.Itoa(int(am)) + ")"
+}
+
+func (am AuthMethod) MarshalText() ([]byte, error) {
+	return []byte(am.String()), nil
+}
+
+// UnmarshalText parses an authentication method name, ignoring case.
+func (am *AuthMethod) UnmarshalText(text []byte) (err error) {
+	err = ErrAuthMethodNotSupported
+	for k, s := range authMethodText {
+		if strings.EqualFold(s, string(text)) {
+			*am = k
+			err = nil
+		}
+	}
+	return
+}
@@ -0,0 +1,20 @@
+package socks5_test
+
+import (
+	"testing"
+
+	"github.com/linkdata/socks5"
+)
+
+func TestAuthMethod_String(t *testing.T) {
+	for am, want := range map[socks5.AuthMethod]string{
+		socks5.AuthMethodNone:   "none",
+		socks5.AuthUserPass:     "userpass",
+		socks5.AuthNoAcceptable: "noacceptable",
+		socks5.AuthMethod(0x42): "method(66)",
+	} {
+		if got := am.String(); got != want {
+			t.Errorf("%q != %q", got, want)
+		}
+	}
+}
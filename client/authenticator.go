@@ -0,0 +1,199 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/url"
+
+	"github.com/linkdata/socks5"
+)
+
+// Authenticator provides the client side of an authentication method.
+type Authenticator interface {
+	// AuthMethod returns the authentication method to offer the server.
+	AuthMethod() socks5.AuthMethod
+	// Socks5Authenticate performs the method specific sub-negotiation after the server has
+	// selected the method. It returns the connection to use for the rest of the session,
+	// which is conn unless the method encapsulates the session.
+	Socks5Authenticate(conn net.Conn, address string) (newconn net.Conn, err error)
+}
+
+// NoAuthAuthenticator offers the "No Authentication" method.
+type NoAuthAuthenticator struct{}
+
+func (a NoAuthAuthenticator) AuthMethod() socks5.AuthMethod {
+	return socks5.AuthMethodNone
+}
+
+func (a NoAuthAuthenticator) Socks5Authenticate(conn net.Conn, _ string) (net.Conn, error) {
+	return conn, nil
+}
+
+// UserPassAuthenticator offers username/password authentication (RFC 1929).
+// The password is sent in clear text.
+type UserPassAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (a UserPassAuthenticator) AuthMethod() socks5.AuthMethod {
+	return socks5.AuthUserPass
+}
+
+func (a UserPassAuthenticator) Socks5Authenticate(conn net.Conn, _ string) (_ net.Conn, err error) {
+	var b []byte
+	b = append(b, socks5.AuthUserPassVersion)
+	if b, err = socks5.AppendString(b, a.Username, socks5.ErrIllegalUsername); err == nil {
+		if b, err = socks5.AppendString(b, a.Password, socks5.ErrIllegalPassword); err == nil {
+			if _, err = conn.Write(b); err == nil {
+				var header [2]byte
+				if _, err = io.ReadFull(conn, header[:]); err == nil {
+					if err = socks5.MustEqual(header[0], socks5.AuthUserPassVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+						err = socks5.MustEqual(header[1], 0, socks5.ErrAuthFailed)
+					}
+				}
+			}
+		}
+	}
+	return conn, err
+}
+
+// HMACAuthenticator offers the private socks5.AuthHMAC challenge-response method,
+// which proves knowledge of the shared secret without sending it.
+type HMACAuthenticator struct {
+	Username string
+	Secret   string
+}
+
+func (a HMACAuthenticator) AuthMethod() socks5.AuthMethod {
+	return socks5.AuthHMAC
+}
+
+func (a HMACAuthenticator) Socks5Authenticate(conn net.Conn, _ string) (_ net.Conn, err error) {
+	var b []byte
+	b = append(b, socks5.AuthPrivateVersion)
+	if b, err = socks5.AppendString(b, a.Username, socks5.ErrIllegalUsername); err == nil {
+		if _, err = conn.Write(b); err == nil {
+			challenge := make([]byte, 1+socks5.HMACChallengeSize)
+			if _, err = io.ReadFull(conn, challenge); err == nil {
+				if err = socks5.MustEqual(challenge[0], socks5.AuthPrivateVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+					b = append(b[:0], socks5.AuthPrivateVersion)
+					b = append(b, socks5.HMACResponse([]byte(a.Secret), a.Username, challenge[1:])...)
+					if _, err = conn.Write(b); err == nil {
+						err = readPrivateAuthResult(conn)
+					}
+				}
+			}
+		}
+	}
+	return conn, err
+}
+
+// TokenAuthenticator offers the private socks5.AuthToken bearer token method.
+type TokenAuthenticator struct {
+	Token string // token made by socks5.SignToken
+}
+
+func (a TokenAuthenticator) AuthMethod() socks5.AuthMethod {
+	return socks5.AuthToken
+}
+
+func (a TokenAuthenticator) Socks5Authenticate(conn net.Conn, _ string) (_ net.Conn, err error) {
+	err = socks5.ErrIllegalPassword
+	if len(a.Token) <= math.MaxUint16 {
+		var b []byte
+		b = append(b, socks5.AuthPrivateVersion)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.Token)))
+		b = append(b, a.Token...)
+		if _, err = conn.Write(b); err == nil {
+			err = readPrivateAuthResult(conn)
+		}
+	}
+	return conn, err
+}
+
+func readPrivateAuthResult(conn net.Conn) (err error) {
+	var result [2]byte
+	if _, err = io.ReadFull(conn, result[:]); err == nil {
+		if err = socks5.MustEqual(result[0], socks5.AuthPrivateVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+			err = socks5.MustEqual(result[1], socks5.AuthSuccess, socks5.ErrAuthFailed)
+		}
+	}
+	return
+}
+
+// GSSAPIAuthenticator offers GSS-API authentication (RFC 1961). Once authenticated,
+// the rest of the session is encapsulated according to the negotiated protection level.
+type GSSAPIAuthenticator struct {
+	Mechanism  socks5.GSSAPIMechanism  // creates the initiating security context
+	Protection socks5.GSSAPIProtection // protection level to request, zero for socks5.GSSAPIConfidentiality
+}
+
+func (a GSSAPIAuthenticator) AuthMethod() socks5.AuthMethod {
+	return socks5.AuthGSSAPI
+}
+
+func (a GSSAPIAuthenticator) Socks5Authenticate(proxyconn net.Conn, address string) (conn net.Conn, err error) {
+	conn = proxyconn
+	var gc socks5.GSSAPIContext
+	if gc, err = a.Mechanism.NewGSSAPIContext(address); err == nil {
+		var input, output []byte
+		var established bool
+		for err == nil && !established {
+			if output, established, err = gc.Step(input); err == nil && (len(output) > 0 || !established) {
+				if err = socks5.WriteGSSAPIMessage(proxyconn, socks5.GSSAPITypeAuthentication, output); err == nil {
+					input, err = socks5.ReadGSSAPIMessage(proxyconn, socks5.GSSAPITypeAuthentication)
+				}
+			}
+		}
+		if err == nil {
+			level := a.Protection
+			if level == 0 {
+				level = socks5.GSSAPIConfidentiality
+			}
+			if err = socks5.WriteGSSAPIProtection(proxyconn, gc, level); err == nil {
+				if level, err = socks5.ReadGSSAPIProtection(proxyconn, gc); err == nil {
+					conn = socks5.NewGSSAPIConn(proxyconn, gc, level)
+				}
+			}
+		}
+	}
+	if err != nil {
+		if err != socks5.ErrGSSAPIAborted {
+			_ = socks5.WriteGSSAPIMessage(proxyconn, socks5.GSSAPITypeAbort, nil)
+		}
+		err = socks5.JoinErrs(socks5.ErrAuthFailed, err)
+	}
+	return
+}
+
+// urlAuthenticators returns the Authenticators to use given the proxy URL.
+//
+// If the URL has credentials, only the method selected by the "auth" query parameter
+// is offered, so that the server can't bypass the credentials by choosing no authentication.
+func urlAuthenticators(u *url.URL) (auths []Authenticator, err error) {
+	if usr := u.User; usr != nil {
+		am := socks5.AuthUserPass
+		if s := u.Query().Get("auth"); s != "" {
+			err = am.UnmarshalText([]byte(s))
+		}
+		if err == nil {
+			pwd, _ := usr.Password()
+			switch am {
+			case socks5.AuthUserPass:
+				auths = append(auths, UserPassAuthenticator{Username: usr.Username(), Password: pwd})
+			case socks5.AuthHMAC:
+				auths = append(auths, HMACAuthenticator{Username: usr.Username(), Secret: pwd})
+			case socks5.AuthToken:
+				auths = append(auths, TokenAuthenticator{Token: pwd})
+			default:
+				err = socks5.ErrAuthMethodNotSupported
+			}
+		}
+	} else {
+		auths = append(auths, NoAuthAuthenticator{})
+	}
+	return
+}
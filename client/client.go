@@ -2,8 +2,10 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"net/netip"
 	"net/url"
@@ -17,6 +19,26 @@ type Client struct {
 	ProxyDialer         socks5.ContextDialer // dialer to use when dialing the SOCKS5 server, nil for socks5.DefaultDialer
 	socks5.HostLookuper                      // resolver to use, nil for net.DefaultResolver
 	LocalResolve        bool                 // if true, always resolve hostnames with HostLookuper
+	UseTLS              bool                 // if true, the connection to the SOCKS5 server uses TLS
+	Socks4              bool                 // if true, use SOCKS4, or SOCKS4a for hostnames, with the URL username as USERID
+	TLSConfig           *tls.Config          // TLS configuration if UseTLS is set, nil for defaults
+
+	// AddressFamily selects which addresses resolved by LocalResolve are used, and in what order.
+	// When a CONNECT target resolves to several addresses, they are tried through the proxy server
+	// as in RFC 8305, starting another attempt every ConnectionAttemptDelay until one succeeds.
+	// SOCKS4 can only address IPv4 targets, so it always uses AddressFamilyIPv4Only.
+	AddressFamily          AddressFamily
+	ConnectionAttemptDelay time.Duration // If zero, DefaultConnectionAttemptDelay is used
+
+	// Authenticators are offered to the server in the given order, at most 255 of them.
+	// If nil, they are derived from the URL; see NewFromURL.
+	Authenticators []Authenticator
+
+	// DeclareUDPAddr, if true, sends the port of the local UDP socket along with its IP address in
+	// ASSOCIATE requests, letting the server check datagram sources more strictly. Don't set it if
+	// there may be NAT between the client and the server, since the server would then drop the
+	// datagrams. Otherwise port zero is sent.
+	DeclareUDPAddr bool
 }
 
 var ErrNotContextDialer = errors.New("not a ContextDialer")
@@ -43,20 +65,47 @@ func FromURL(u *url.URL, forward socks5.Dialer) (d socks5.Dialer, err error) {
 	return
 }
 
+// NewFromURL returns a Client for the proxy server in the URL.
+//
+// The URL query parameter "auth" selects how the credentials in the URL are used:
+// "userpass" (the default) sends them in clear text, "hmac" uses the password as
+// the secret in a challenge-response, and "token" sends the password as a bearer token.
+// If the URL has credentials, no authentication is not offered.
+//
+// The schemes "socks5s" or "socks5+tls" and "socks5hs" or "socks5h+tls" connect to
+// the server using TLS. UDP datagrams for ASSOCIATE are not encrypted.
+//
+// The schemes "socks4" and "socks4a" use SOCKS4 and SOCKS4a, which support CONNECT and BIND.
 func NewFromURL(u *url.URL) (cli *Client, err error) {
-	var localResolve bool
+	var localResolve, useTLS, socks4 bool
 	err = socks5.ErrUnsupportedScheme
 	switch u.Scheme {
+	case "socks4":
+		localResolve = true
+		fallthrough
+	case "socks4a":
+		socks4 = true
+		err = nil
+	case "socks5s", "socks5+tls":
+		useTLS = true
+		fallthrough
 	case "socks5":
 		localResolve = true
+		err = nil
+	case "socks5hs", "socks5h+tls":
+		useTLS = true
 		fallthrough
 	case "socks5h":
 		err = nil
 	}
 	if err == nil {
-		cli = &Client{
-			URL:          u,
-			LocalResolve: localResolve,
+		if _, err = urlAuthenticators(u); err == nil {
+			cli = &Client{
+				URL:          u,
+				LocalResolve: localResolve,
+				UseTLS:       useTLS,
+				Socks4:       socks4,
+			}
 		}
 	}
 	return
@@ -76,11 +125,45 @@ func (cli *Client) DialContext(ctx context.Context, network, address string) (co
 	case "tcp", "tcp4", "tcp6":
 		conn, _, err = cli.do(ctx, socks5.CommandConnect, address)
 	case "udp", "udp4", "udp6":
-		conn, _, err = cli.do(ctx, socks5.CommandAssociate, address)
+		if !cli.Socks4 {
+			conn, _, err = cli.do(ctx, socks5.CommandAssociate, address)
+		}
+	}
+	return
+}
+
+// ListenPacket returns a net.PacketConn that sends datagrams to and receives them from
+// any address using a single ASSOCIATE session. Its LocalAddr is the address the proxy
+// server relays from. The address is accepted for compatibility with net.ListenPacket and ignored;
+// the local UDP socket is bound to the IP address used to reach the proxy server. The network
+// may be "udp4" or "udp6" only if that is the address family used to reach the proxy server.
+func (cli *Client) ListenPacket(ctx context.Context, network, address string) (pc net.PacketConn, err error) {
+	err = socks5.ErrUnsupportedNetwork
+	switch network {
+	case "udp", "udp4", "udp6":
+		if !cli.Socks4 {
+			var conn net.Conn
+			if conn, _, err = cli.do(ctx, socks5.CommandAssociate, ""); err == nil {
+				uc := conn.(*UDPConn)
+				if pc = uc; !udpNetworkMatches(network, uc.Conn.LocalAddr()) {
+					_ = uc.Close()
+					pc, err = nil, socks5.ErrUnsupportedNetwork
+				}
+			}
+		}
 	}
 	return
 }
 
+// udpNetworkMatches returns true if network is "udp", or names the address family of addr.
+func udpNetworkMatches(network string, addr net.Addr) bool {
+	if network == "udp" {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	return err == nil && ap.Addr().Unmap().Is4() == (network == "udp4")
+}
+
 func (cli *Client) Dial(network, address string) (net.Conn, error) {
 	return cli.DialContext(context.Background(), network, address)
 }
@@ -98,26 +181,32 @@ func (cli *Client) Listen(network, address string) (l net.Listener, err error) {
 	return cli.ListenContext(context.Background(), network, address)
 }
 
-func (cli *Client) resolve(ctx context.Context, hostport string) (ipandport string, err error) {
-	ipandport = hostport
-	if cli.LocalResolve {
+// resolve returns the addresses to try for hostport, which is returned as-is unless
+// LocalResolve is set and the host is a name.
+func (cli *Client) resolve(ctx context.Context, hostport string) (addresses []string, err error) {
+	addresses = []string{hostport}
+	if cli.LocalResolve && hostport != "" {
 		var host, port string
 		if host, port, err = net.SplitHostPort(hostport); err == nil && host != "" {
 			if _, e := netip.ParseAddr(host); e != nil {
-				var addrs []string
-				if addrs, err = cli.resolver().LookupHost(ctx, host); err == nil {
-					var useip netip.Addr
-					for _, s := range addrs {
-						if useip, err = netip.ParseAddr(s); err == nil {
-							useip = useip.Unmap()
-							if useip.Is4() {
-								break
-							}
+				var names []string
+				if names, err = cli.resolver().LookupHost(ctx, host); err == nil {
+					var ips []netip.Addr
+					for _, s := range names {
+						if ip, e := netip.ParseAddr(s); e == nil {
+							ips = append(ips, ip)
 						}
 					}
-					if useip.IsValid() {
-						ipandport = net.JoinHostPort(useip.String(), port)
-						err = nil
+					af := cli.AddressFamily
+					if cli.Socks4 {
+						af = AddressFamilyIPv4Only
+					}
+					addresses = nil
+					for _, ip := range af.sortAddrs(ips) {
+						addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+					}
+					if len(addresses) == 0 {
+						err = &net.AddrError{Err: "no suitable address", Addr: host}
 					}
 				}
 			}
@@ -127,10 +216,54 @@ func (cli *Client) resolve(ctx context.Context, hostport string) (ipandport stri
 }
 
 func (cli *Client) do(ctx context.Context, cmd socks5.CommandType, address string) (conn net.Conn, addr socks5.Addr, err error) {
-	if address, err = cli.resolve(ctx, address); err == nil {
-		if conn, err = cli.proxyDial(ctx, "tcp", cli.URL.Host); err == nil {
+	var addresses []string
+	if addresses, err = cli.resolve(ctx, address); err == nil {
+		if cmd == socks5.CommandConnect && len(addresses) > 1 {
+			conn, addr, err = cli.race(ctx, cmd, addresses)
+		} else {
+			conn, addr, err = cli.attempt(ctx, cmd, addresses[0])
+		}
+	}
+	return
+}
+
+// attempt connects to the proxy server and performs the request for address.
+// The connection is closed if ctx is cancelled before the request completes.
+func (cli *Client) attempt(ctx context.Context, cmd socks5.CommandType, address string) (conn net.Conn, addr socks5.Addr, err error) {
+	var proxyconn net.Conn
+	if proxyconn, err = cli.proxyDial(ctx, "tcp", cli.URL.Host); err == nil {
+		stop := context.AfterFunc(ctx, func() { _ = proxyconn.Close() })
+		if conn, err = cli.startTLS(ctx, proxyconn); err == nil {
 			conn, addr, err = cli.connect(ctx, conn, cmd, address)
 		}
+		if !stop() && err == nil {
+			_ = conn.Close()
+			conn, err = nil, ctx.Err()
+		}
+		if err != nil {
+			_ = proxyconn.Close()
+		}
+	}
+	return
+}
+
+// startTLS performs the TLS handshake with the SOCKS5 server if UseTLS is set.
+func (cli *Client) startTLS(ctx context.Context, proxyconn net.Conn) (conn net.Conn, err error) {
+	conn = proxyconn
+	if cli.UseTLS {
+		cfg := &tls.Config{}
+		if cli.TLSConfig != nil {
+			cfg = cli.TLSConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = cli.URL.Hostname()
+		}
+		tc := tls.Client(proxyconn, cfg)
+		if err = tc.HandshakeContext(ctx); err == nil {
+			conn = tc
+		} else {
+			_ = proxyconn.Close()
+		}
 	}
 	return
 }
@@ -140,7 +273,14 @@ func (cli *Client) connect(ctx context.Context, proxyconn net.Conn, cmd socks5.C
 		_ = proxyconn.SetDeadline(deadline)
 		defer proxyconn.SetDeadline(time.Time{})
 	}
-	if err = cli.connectAuth(proxyconn); err == nil {
+	if cli.Socks4 {
+		err = socks5.ErrReplyCommandNotSupported
+		if cmd == socks5.CommandConnect || cmd == socks5.CommandBind {
+			if addr, err = cli.connectSocks4(proxyconn, cmd, address); err == nil {
+				conn = proxyconn
+			}
+		}
+	} else if proxyconn, err = cli.connectAuth(proxyconn); err == nil {
 		err = socks5.ErrReplyCommandNotSupported
 		switch cmd {
 		case socks5.CommandConnect:
@@ -152,57 +292,109 @@ func (cli *Client) connect(ctx context.Context, proxyconn net.Conn, cmd socks5.C
 				conn = proxyconn
 			}
 		case socks5.CommandAssociate:
-			if addr, err = cli.connectCommand(proxyconn, socks5.CommandAssociate, ":0"); err == nil {
-				if conn, err = cli.proxyDial(ctx, "udp", addr.String()); err == nil {
-					if conn, err = NewUDPConn(conn, proxyconn, address); err == nil {
-						go func() {
-							defer conn.Close()
-							_, _ = io.Copy(io.Discard, proxyconn)
-						}()
-					}
+			conn, addr, err = cli.associate(ctx, proxyconn, address)
+		}
+	}
+	return
+}
+
+// associate performs an ASSOCIATE request. If possible, the UDP socket is bound first so
+// the server can be told the address the datagrams will come from.
+func (cli *Client) associate(ctx context.Context, proxyconn net.Conn, address string) (conn net.Conn, addr socks5.Addr, err error) {
+	var pc net.PacketConn
+	clientAddr := ":0"
+	if pc, err = cli.listenUDP(ctx, proxyconn); err == nil && pc != nil {
+		clientAddr = pc.LocalAddr().String()
+		if !cli.DeclareUDPAddr {
+			host, _, _ := net.SplitHostPort(clientAddr)
+			clientAddr = net.JoinHostPort(host, "0")
+		}
+	}
+	if err == nil {
+		if addr, err = cli.connectCommand(proxyconn, socks5.CommandAssociate, clientAddr); err == nil {
+			relayAddr := addr
+			relayAddr.ReplaceAny(proxyconn.RemoteAddr().String())
+			if pc != nil {
+				var ua *net.UDPAddr
+				if ua, err = net.ResolveUDPAddr("udp", relayAddr.String()); err == nil {
+					conn = &relayConn{PacketConn: pc, relay: ua}
 				}
+			} else {
+				conn, err = cli.proxyDial(ctx, "udp", relayAddr.String())
 			}
+			if err == nil {
+				var uc *UDPConn
+				if uc, err = NewUDPConn(conn, proxyconn, address); err == nil {
+					uc.boundAddr = udpAddr{relayAddr}
+					conn = uc
+					go func() {
+						defer conn.Close()
+						_, _ = io.Copy(io.Discard, proxyconn)
+					}()
+				}
+			}
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+			conn = nil
 		}
+		if pc != nil {
+			_ = pc.Close()
+		}
+		_ = proxyconn.Close()
 	}
 	return
 }
 
-func (cli *Client) connectAuth(conn net.Conn) (err error) {
-	var auths []byte
-	auths = append(auths, byte(socks5.AuthMethodNone))
-	usr := cli.URL.User
-	if usr != nil {
-		auths = append(auths, byte(socks5.AuthUserPass))
+// listenUDP returns a packet connection bound to the local IP address of proxyconn,
+// or nil if the ProxyDialer can't provide one.
+func (cli *Client) listenUDP(ctx context.Context, proxyconn net.Conn) (pc net.PacketConn, err error) {
+	var pl socks5.PacketListener
+	switch d := cli.proxyDialer().(type) {
+	case socks5.PacketListener:
+		pl = d
+	case *net.Dialer:
+		pl = &net.ListenConfig{Control: d.Control}
 	}
+	if pl != nil {
+		var host string
+		if host, _, err = net.SplitHostPort(proxyconn.LocalAddr().String()); err == nil {
+			pc, err = pl.ListenPacket(ctx, "udp", net.JoinHostPort(host, "0"))
+		}
+	}
+	return
+}
 
-	var b []byte
-	b = append(b, socks5.Socks5Version, byte(len(auths)))
-	b = append(b, auths...)
-
-	if _, err = conn.Write(b); err == nil {
-		var header [2]byte
-		if _, err = io.ReadFull(conn, header[:]); err == nil {
-			if err = socks5.MustEqual(header[0], socks5.Socks5Version, socks5.ErrVersion); err == nil {
-				err = socks5.ErrAuthMethodNotSupported
-				switch authmethod := socks5.AuthMethod(header[1]); authmethod {
-				case socks5.AuthNoAcceptable:
-					err = socks5.ErrNoAcceptableAuthMethods
-				case socks5.AuthMethodNone:
-					err = nil
-				case socks5.AuthUserPass:
-					if usr != nil {
-						var b []byte
-						b = append(b, socks5.AuthUserPassVersion)
-						if b, err = socks5.AppendString(b, usr.Username(), socks5.ErrIllegalUsername); err == nil {
-							pwd, _ := usr.Password()
-							if b, err = socks5.AppendString(b, pwd, socks5.ErrIllegalPassword); err == nil {
-								if _, err = conn.Write(b); err == nil {
-									if _, err = io.ReadFull(conn, header[:]); err == nil {
-										if err = socks5.MustEqual(header[0], socks5.AuthUserPassVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
-											err = socks5.MustEqual(header[1], 0, socks5.ErrAuthFailed)
-										}
-									}
-								}
+func (cli *Client) connectAuth(proxyconn net.Conn) (conn net.Conn, err error) {
+	conn = proxyconn
+	auths := cli.Authenticators
+	if auths == nil {
+		auths, err = urlAuthenticators(cli.URL)
+	}
+	if err == nil {
+		err = socks5.MustEqual(len(auths) <= math.MaxUint8, true, socks5.ErrTooManyAuthMethods)
+	}
+	if err == nil {
+		var b []byte
+		b = append(b, socks5.Socks5Version, byte(len(auths)))
+		for _, auth := range auths {
+			b = append(b, byte(auth.AuthMethod()))
+		}
+		if _, err = conn.Write(b); err == nil {
+			var header [2]byte
+			if _, err = io.ReadFull(conn, header[:]); err == nil {
+				if err = socks5.MustEqual(header[0], socks5.Socks5Version, socks5.ErrVersion); err == nil {
+					err = socks5.ErrAuthMethodNotSupported
+					authmethod := socks5.AuthMethod(header[1])
+					if authmethod == socks5.AuthNoAcceptable {
+						err = socks5.ErrNoAcceptableAuthMethods
+					} else {
+						for _, auth := range auths {
+							if auth.AuthMethod() == authmethod {
+								conn, err = auth.Socks5Authenticate(proxyconn, cli.URL.Host)
+								break
 							}
 						}
 					}
@@ -229,6 +421,9 @@ func (cli *Client) connectCommand(conn net.Conn, cmd socks5.CommandType, address
 }
 
 func (cli *Client) readReply(conn net.Conn) (addr socks5.Addr, err error) {
+	if cli.Socks4 {
+		return readSocks4Reply(conn)
+	}
 	var header [3]byte
 	if _, err = io.ReadFull(conn, header[:]); err == nil {
 		if err = socks5.MustEqual(header[0], socks5.Socks5Version, socks5.ErrVersion); err == nil {
@@ -248,10 +443,13 @@ func (cli *Client) resolver() (hl socks5.HostLookuper) {
 	return
 }
 
-func (cli *Client) proxyDial(ctx context.Context, network, address string) (conn net.Conn, err error) {
-	proxyDial := cli.ProxyDialer
-	if proxyDial == nil {
-		proxyDial = socks5.DefaultDialer
+func (cli *Client) proxyDialer() (cd socks5.ContextDialer) {
+	if cd = cli.ProxyDialer; cd == nil {
+		cd = socks5.DefaultDialer
 	}
-	return proxyDial.DialContext(ctx, network, address)
+	return
+}
+
+func (cli *Client) proxyDial(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	return cli.proxyDialer().DialContext(ctx, network, address)
 }
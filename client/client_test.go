@@ -1,10 +1,13 @@
 package client_test
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"log/slog"
 	"net"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -68,12 +71,101 @@ func TestClient_New(t *testing.T) {
 		t.Error("LocalResolve")
 	}
 
+	for _, scheme := range []string{"socks5s", "socks5+tls", "socks5hs", "socks5h+tls"} {
+		if cli, err = client.New(scheme + "://localhost:1080"); err != nil {
+			t.Fatal(err)
+		}
+		if !cli.UseTLS || cli.LocalResolve != !strings.HasPrefix(scheme, "socks5h") {
+			t.Error(scheme, cli.UseTLS, cli.LocalResolve)
+		}
+	}
+
 	_, err = client.New("http://localhost")
 	if err != socks5.ErrUnsupportedScheme {
 		t.Error(err)
 	}
 }
 
+func TestClient_New_Auth(t *testing.T) {
+	for _, s := range []string{"", "?auth=userpass", "?auth=HMAC", "?auth=token"} {
+		if _, err := client.New("socks5h://u:p@localhost:1080" + s); err != nil {
+			t.Error(s, err)
+		}
+	}
+	for _, s := range []string{"?auth=bogus", "?auth=none", "?auth=gssapi"} {
+		if _, err := client.New("socks5h://u:p@localhost:1080" + s); err != socks5.ErrAuthMethodNotSupported {
+			t.Error(s, err)
+		}
+	}
+}
+
+// methodServer is a fake proxy that selects the given auth method and records what the client offered.
+// The offered channel is closed when the client closes the connection.
+func methodServer(t *testing.T, am socks5.AuthMethod) (addr string, offered chan []byte) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	offered = make(chan []byte, 1)
+	go func() {
+		defer close(offered)
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+			var hdr [2]byte
+			if _, err = io.ReadFull(conn, hdr[:]); err == nil {
+				methods := make([]byte, hdr[1])
+				if _, err = io.ReadFull(conn, methods); err == nil {
+					offered <- methods
+					_, _ = conn.Write([]byte{socks5.Socks5Version, byte(am)})
+					_, _ = io.Copy(io.Discard, conn)
+				}
+			}
+		}
+	}()
+	return l.Addr().String(), offered
+}
+
+func TestClient_Authenticators_NoFallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	addr, offered := methodServer(t, socks5.AuthMethodNone)
+	cli, err := client.New("socks5h://u:p@" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrAuthMethodNotSupported {
+		t.Error(err)
+	}
+	if methods := <-offered; !bytes.Equal(methods, []byte{byte(socks5.AuthUserPass)}) {
+		t.Error(methods)
+	}
+}
+
+func TestClient_Authenticators_Order(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	addr, offered := methodServer(t, socks5.AuthNoAcceptable)
+	cli, err := client.New("socks5h://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Authenticators = []client.Authenticator{
+		client.HMACAuthenticator{Username: "u", Secret: "s"},
+		client.UserPassAuthenticator{Username: "u", Password: "p"},
+		client.NoAuthAuthenticator{},
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrNoAcceptableAuthMethods {
+		t.Error(err)
+	}
+	if methods := <-offered; !bytes.Equal(methods, []byte{byte(socks5.AuthHMAC), byte(socks5.AuthUserPass), byte(socks5.AuthMethodNone)}) {
+		t.Error(methods)
+	}
+}
+
 func TestClient_FromURL(t *testing.T) {
 	u, err := url.Parse("socks5h://localhost:1080")
 	if err != nil {
@@ -84,3 +176,40 @@ func TestClient_FromURL(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClient_ClosesFailedAttempt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	addr, offered := methodServer(t, socks5.AuthNoAcceptable)
+	cli, err := client.New("socks5h://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrNoAcceptableAuthMethods {
+		t.Error(err)
+	}
+	<-offered
+	select {
+	case <-offered:
+	case <-time.After(time.Second):
+		t.Error("connection to the proxy not closed")
+	}
+}
+
+func TestClient_Authenticators_TooMany(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	addr, _ := methodServer(t, socks5.AuthNoAcceptable)
+	cli, err := client.New("socks5h://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 256 {
+		cli.Authenticators = append(cli.Authenticators, client.NoAuthAuthenticator{})
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrTooManyAuthMethods {
+		t.Error(err)
+	}
+}
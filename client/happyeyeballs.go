@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// AddressFamily selects which resolved addresses are used, and in what order, when LocalResolve is set.
+type AddressFamily byte
+
+const (
+	AddressFamilyPreferIPv4 AddressFamily = iota // try IPv4 addresses first (the default)
+	AddressFamilyPreferIPv6                      // try IPv6 addresses first
+	AddressFamilyIPv4Only                        // only use IPv4 addresses
+	AddressFamilyIPv6Only                        // only use IPv6 addresses
+)
+
+var addressFamilyText = []string{
+	AddressFamilyPreferIPv4: "prefer-ipv4",
+	AddressFamilyPreferIPv6: "prefer-ipv6",
+	AddressFamilyIPv4Only:   "ipv4-only",
+	AddressFamilyIPv6Only:   "ipv6-only",
+}
+
+func (af AddressFamily) String() string {
+	if int(af) < len(addressFamilyText) {
+		return addressFamilyText[af]
+	}
+	return "addressfamily(" + strconv.Itoa(int(af)) + ")"
+}
+
+// DefaultConnectionAttemptDelay is the delay between starting connection attempts
+// if Client.ConnectionAttemptDelay is zero, as recommended by RFC 8305.
+var DefaultConnectionAttemptDelay = time.Millisecond * 250
+
+// sortAddrs returns the addresses allowed by af, interleaving the families
+// starting with the preferred one (RFC 8305, section 4).
+func (af AddressFamily) sortAddrs(addrs []netip.Addr) (sorted []netip.Addr) {
+	var v4, v6 []netip.Addr
+	for _, ip := range addrs {
+		if ip = ip.Unmap(); ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	switch af {
+	case AddressFamilyPreferIPv6:
+		first, second = v6, v4
+	case AddressFamilyIPv4Only:
+		second = nil
+	case AddressFamilyIPv6Only:
+		first, second = v6, nil
+	}
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			sorted = append(sorted, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			sorted = append(sorted, second[0])
+			second = second[1:]
+		}
+	}
+	return
+}
+
+func (cli *Client) attemptDelay() time.Duration {
+	if cli.ConnectionAttemptDelay > 0 {
+		return cli.ConnectionAttemptDelay
+	}
+	return DefaultConnectionAttemptDelay
+}
+
+type attemptResult struct {
+	conn net.Conn
+	addr socks5.Addr
+	err  error
+}
+
+// race performs the request for each address through the proxy server, starting a new attempt
+// when the previous one fails or after the connection attempt delay, and returns the first to succeed.
+// If all fail, the returned error joins the errors of all attempts. If ctx is done first, ctx.Err() is returned.
+func (cli *Client) race(ctx context.Context, cmd socks5.CommandType, addresses []string) (conn net.Conn, addr socks5.Addr, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan attemptResult, len(addresses))
+	start := func(address string) {
+		go func() {
+			c, a, e := cli.attempt(ctx, cmd, address)
+			results <- attemptResult{conn: c, addr: a, err: socks5.Note(e, address)}
+		}()
+	}
+
+	delay := cli.attemptDelay()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var errs []error
+	start(addresses[0])
+	next, pending := 1, 1
+	for conn == nil && pending > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			continue
+		case <-timer.C:
+		case r := <-results:
+			pending--
+			if conn, addr = r.conn, r.addr; conn != nil {
+				continue
+			}
+			errs = append(errs, r.err)
+		}
+		if next < len(addresses) {
+			start(addresses[next])
+			next++
+			pending++
+			timer.Reset(delay)
+		}
+	}
+
+	if conn == nil && err == nil {
+		err = socks5.JoinErrs(errs...)
+	}
+	if pending > 0 {
+		go func() {
+			for ; pending > 0; pending-- {
+				if r := <-results; r.conn != nil {
+					_ = r.conn.Close()
+				}
+			}
+		}()
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type staticLookuper []string
+
+func (sl staticLookuper) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return sl, nil
+}
+
+// stallingSelector makes the server's dial to 127.0.0.2 hang until cancelled.
+type stallingSelector struct{}
+
+func (stallingSelector) SelectDialer(username, network, address string) (socks5.ContextDialer, error) {
+	return stallingDialer{}, nil
+}
+
+type stallingDialer struct{}
+
+func (stallingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(address, "127.0.0.2:") {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func startEyeballs(t *testing.T, ctx context.Context, addrs ...string) (cli *client.Client, port string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go (&server.Server{DialerSelector: stallingSelector{}}).Serve(ctx, l)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ = net.SplitHostPort(target.Addr().String())
+
+	if cli, err = client.New("socks5://" + l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	cli.HostLookuper = staticLookuper(addrs)
+	cli.ConnectionAttemptDelay = time.Millisecond * 10
+	return
+}
+
+func TestClient_HappyEyeballs_Delay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, port := startEyeballs(t, ctx, "127.0.0.2", "127.0.0.1")
+	started := time.Now()
+	conn, err := cli.DialContext(ctx, "tcp", net.JoinHostPort("eyeballs.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if d := time.Since(started); d > time.Second {
+		t.Error(d)
+	}
+}
+
+func TestClient_HappyEyeballs_AllFail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, _ := startEyeballs(t, ctx, "127.0.0.3", "127.0.0.4")
+	_, err := cli.DialContext(ctx, "tcp", "eyeballs.test:1")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, s := range []string{"127.0.0.3:1", "127.0.0.4:1"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClient_HappyEyeballs_Cancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, port := startEyeballs(t, ctx, "127.0.0.2", "127.0.0.2")
+	dialctx, dialcancel := context.WithCancel(ctx)
+	time.AfterFunc(time.Millisecond*50, dialcancel)
+	if _, err := cli.DialContext(dialctx, "tcp", net.JoinHostPort("eyeballs.test", port)); !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+}
+
+func TestClient_AddressFamily(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, port := startEyeballs(t, ctx, "::1", "127.0.0.1")
+	address := net.JoinHostPort("eyeballs.test", port)
+
+	cli.AddressFamily = client.AddressFamilyIPv4Only
+	conn, err := cli.DialContext(ctx, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	cli.AddressFamily = client.AddressFamilyIPv6Only
+	if _, err = cli.DialContext(ctx, "tcp", address); err == nil {
+		t.Error("expected error")
+	}
+
+	cli.HostLookuper = staticLookuper{"127.0.0.1"}
+	var aerr *net.AddrError
+	if _, err = cli.DialContext(ctx, "tcp", address); !errors.As(err, &aerr) {
+		t.Error(err)
+	}
+
+	if s := client.AddressFamilyPreferIPv6.String(); s != "prefer-ipv6" {
+		t.Error(s)
+	}
+}
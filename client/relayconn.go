@@ -0,0 +1,34 @@
+package client
+
+import (
+	"net"
+)
+
+// relayConn is a net.Conn exchanging datagrams with the proxy server UDP relay using an unconnected PacketConn.
+type relayConn struct {
+	net.PacketConn
+	relay *net.UDPAddr
+}
+
+var _ net.Conn = &relayConn{}
+
+// Read reads the next datagram from the relay, discarding datagrams from other sources.
+func (c *relayConn) Read(b []byte) (n int, err error) {
+	for err == nil {
+		var addr net.Addr
+		if n, addr, err = c.PacketConn.ReadFrom(b); err == nil {
+			if ua, ok := addr.(*net.UDPAddr); ok && ua.IP.Equal(c.relay.IP) && ua.Port == c.relay.Port {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (c *relayConn) Write(b []byte) (int, error) {
+	return c.PacketConn.WriteTo(b, c.relay)
+}
+
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.relay
+}
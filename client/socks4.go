@@ -0,0 +1,69 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/linkdata/socks5"
+)
+
+// connectSocks4 sends a SOCKS4 request, or a SOCKS4a request if the host in address is not an IP address.
+// The USERID and hostname are NUL terminated, so they may not contain NUL.
+func (cli *Client) connectSocks4(conn net.Conn, cmd socks5.CommandType, address string) (proxyaddr socks5.Addr, err error) {
+	var host string
+	var port uint16
+	if host, port, err = socks5.SplitHostPort(address); err == nil {
+		var hostname string
+		ip := netip.IPv4Unspecified()
+		if host != "" {
+			if ip, err = netip.ParseAddr(host); err != nil {
+				ip = netip.AddrFrom4([4]byte{0, 0, 0, 1})
+				hostname = host
+				err = nil
+			} else if ip = ip.Unmap(); ip.IsUnspecified() {
+				ip = netip.IPv4Unspecified()
+			} else if !ip.Is4() {
+				err = socks5.ErrSocks4IPv6Address
+			}
+		}
+		if err == nil && strings.IndexByte(hostname, 0) >= 0 {
+			err = socks5.ErrInvalidSocks4Request
+		}
+		if err == nil && strings.IndexByte(cli.URL.User.Username(), 0) >= 0 {
+			err = socks5.ErrIllegalUsername
+		}
+		if err == nil {
+			var b []byte
+			b = append(b, socks5.Socks4Version, byte(cmd))
+			b = binary.BigEndian.AppendUint16(b, port)
+			b = append(b, ip.AsSlice()...)
+			b = append(b, cli.URL.User.Username()...)
+			b = append(b, 0)
+			if hostname != "" {
+				b = append(b, hostname...)
+				b = append(b, 0)
+			}
+			if _, err = conn.Write(b); err == nil {
+				proxyaddr, err = readSocks4Reply(conn)
+				err = socks5.Note(err, "connectSocks4")
+			}
+		}
+	}
+	return
+}
+
+func readSocks4Reply(conn net.Conn) (addr socks5.Addr, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(conn, b[:]); err == nil {
+		if err = socks5.MustEqual(b[0], socks5.Socks4ReplyVersion, socks5.ErrVersion); err == nil {
+			replyCode := socks5.Socks4ReplyCode(b[1])
+			if err = socks5.MustEqual(replyCode, socks5.Socks4Granted, replyCode.ToError()); err == nil {
+				addr = socks5.AddrFromHostPort(netip.AddrFrom4([4]byte(b[4:8])).String(), binary.BigEndian.Uint16(b[2:4]))
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func startSocks4Server(t *testing.T, ctx context.Context) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go (&server.Server{AllowSOCKS4: true}).Serve(ctx, l)
+	return l.Addr().String()
+}
+
+func echoOnce(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Error(string(buf), err)
+	}
+}
+
+func TestClient_Socks4_Connect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	proxy := startSocks4Server(t, ctx)
+	for _, scheme := range []string{"socks4", "socks4a"} {
+		cli, err := client.New(scheme + "://joe@" + proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cli.Socks4 || cli.LocalResolve != (scheme == "socks4") {
+			t.Error(scheme, cli.Socks4, cli.LocalResolve)
+		}
+		conn, err := cli.DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal(scheme, err)
+		}
+		echoOnce(t, conn)
+		_ = conn.Close()
+	}
+
+	// SOCKS4 can't reach IPv6 targets, so only IPv4 addresses are used
+	cli, err := client.New("socks4://" + proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.HostLookuper = staticLookuper{"::1", "127.0.0.1"}
+	cli.AddressFamily = client.AddressFamilyIPv6Only
+	conn, err := cli.DialContext(ctx, "tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn)
+	_ = conn.Close()
+}
+
+func TestClient_Socks4_Bind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, err := client.New("socks4a://" + startSocks4Server(t, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := cli.ListenContext(ctx, "tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for range 2 {
+		remote, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != remote.LocalAddr().String() {
+			t.Error(conn.RemoteAddr(), remote.LocalAddr())
+		}
+		go func() { _, _ = io.Copy(remote, remote) }()
+		echoOnce(t, conn)
+		_ = conn.Close()
+		_ = remote.Close()
+	}
+}
+
+func TestClient_Socks4_Errors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	cli, err := client.New("socks4a://" + startSocks4Server(t, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "udp", "127.0.0.1:1"); err != socks5.ErrUnsupportedNetwork {
+		t.Error(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "[::1]:1"); err != socks5.ErrSocks4IPv6Address {
+		t.Error(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "a\x00b:1"); err != socks5.ErrInvalidSocks4Request {
+		t.Error(err)
+	}
+	cli.URL.User = url.User("a\x00b")
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrIllegalUsername {
+		t.Error(err)
+	}
+	cli.URL.User = nil
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); !errors.Is(err, socks5.ErrSocks4Rejected) {
+		t.Error(err)
+	}
+}
@@ -1,8 +1,16 @@
 package client_test
 
 import (
+	"context"
+	"errors"
+	"net"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
 	"github.com/linkdata/socks5test"
 )
 
@@ -17,3 +25,85 @@ func TestUDP_Multiple(t *testing.T) {
 func TestUDP_InvalidPacket(t *testing.T) {
 	socks5test.UDP_InvalidPacket(t, srvfn, clifn)
 }
+
+func startUDPEcho(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func TestClient_ListenPacket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&server.Server{}).Serve(ctx, l)
+
+	cli, err := client.New("socks5://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the proxy server is reached over IPv4
+	for _, network := range []string{"tcp", "udp6"} {
+		if _, err = cli.ListenPacket(ctx, network, ""); err != socks5.ErrUnsupportedNetwork {
+			t.Error(network, err)
+		}
+	}
+	pc, err := cli.ListenPacket(ctx, "udp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	if host, _, _ := net.SplitHostPort(pc.LocalAddr().String()); host != "127.0.0.1" {
+		t.Error(pc.LocalAddr())
+	}
+	if _, err = pc.(*client.UDPConn).Write([]byte("x")); err != socks5.ErrNoTargetAddress {
+		t.Error(err)
+	}
+
+	echo1 := startUDPEcho(t)
+	echo2 := startUDPEcho(t)
+	for _, echo := range []net.PacketConn{echo1, echo2} {
+		if _, err = pc.WriteTo([]byte(echo.LocalAddr().String()), echo.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, 64)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	for range 2 {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != addr.String() {
+			t.Error(string(buf[:n]), addr)
+		}
+	}
+
+	_ = pc.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, _, err = pc.ReadFrom(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error(err)
+	}
+	if _, err = pc.(*client.UDPConn).Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"net"
+	"sync"
 
 	"github.com/linkdata/socks5"
 )
@@ -9,10 +10,21 @@ import (
 const maxUDPPrefixLength = 3 + 1 + 1 + 255 + 2 // hdr + addrType + strLen + domainName + port
 var _ net.PacketConn = &UDPConn{}
 
+// UDPConn is a net.PacketConn relaying datagrams through a proxy server ASSOCIATE session.
+// If it was created with a target address it also acts as a net.Conn connected to that target,
+// discarding datagrams from other sources on Read.
 type UDPConn struct {
-	targetAddr net.Addr
+	targetAddr net.Addr // nil if not connected to a target
+	boundAddr  net.Addr // address the proxy server relays from, nil if unknown
 	tcpconn    net.Conn // TCP conn to client
 	net.Conn            // packet connection to the proxy server
+	mu         sync.Mutex
+	rbuf       []byte // read buffer, protected by mu
+
+	// MaxFragmentSize, if nonzero, is the largest payload sent in a single datagram.
+	// Larger payloads are sent in up to socks5.UDPMaxFragments fragments (RFC 1928, section 7),
+	// which the proxy server must support.
+	MaxFragmentSize int
 }
 
 type udpAddr struct {
@@ -23,11 +35,19 @@ func (ua udpAddr) Network() string {
 	return "udp"
 }
 
+// NewUDPConn returns a UDPConn exchanging datagrams with the proxy server over raw, closing tcpconn when closed.
+// If address is empty, the UDPConn is not connected to a target.
 func NewUDPConn(raw, tcpconn net.Conn, address string) (c *UDPConn, err error) {
-	var addr socks5.Addr
-	if addr, err = socks5.AddrFromString(address); err == nil {
+	var targetAddr net.Addr
+	if address != "" {
+		var addr socks5.Addr
+		if addr, err = socks5.AddrFromString(address); err == nil {
+			targetAddr = udpAddr{addr}
+		}
+	}
+	if err == nil {
 		c = &UDPConn{
-			targetAddr: udpAddr{addr},
+			targetAddr: targetAddr,
 			tcpconn:    tcpconn,
 			Conn:       raw,
 		}
@@ -41,7 +61,12 @@ func (c *UDPConn) Close() (err error) {
 }
 
 func (c *UDPConn) ReadFrom(p []byte) (n int, netaddr net.Addr, err error) {
-	buf := make([]byte, len(p)+maxUDPPrefixLength)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size := len(p) + maxUDPPrefixLength; cap(c.rbuf) < size {
+		c.rbuf = make([]byte, size)
+	}
+	buf := c.rbuf[:len(p)+maxUDPPrefixLength]
 	if n, err = c.Conn.Read(buf); err == nil {
 		var pkt *socks5.UDPPacket
 		if pkt, err = socks5.ParseUDPPacket(buf[:n]); err == nil {
@@ -55,31 +80,57 @@ func (c *UDPConn) ReadFrom(p []byte) (n int, netaddr net.Addr, err error) {
 func (c *UDPConn) Read(b []byte) (n int, err error) {
 	for err == nil {
 		var netaddr net.Addr
-		n, netaddr, err = c.ReadFrom(b)
-		if netaddr.String() == c.targetAddr.String() {
-			break
+		if n, netaddr, err = c.ReadFrom(b); err == nil {
+			if c.targetAddr == nil || netaddr.String() == c.targetAddr.String() {
+				break
+			}
 		}
 	}
 	return
 }
 
 func (c *UDPConn) writeTo(p []byte, addr socks5.Addr) (n int, err error) {
+	size := len(p)
+	if c.MaxFragmentSize > 0 && len(p) > c.MaxFragmentSize {
+		size = c.MaxFragmentSize
+	}
+	var frags int
+	if size > 0 {
+		frags = (len(p) + size - 1) / size
+	}
+	if frags > socks5.UDPMaxFragments {
+		err = socks5.ErrTooManyFragments
+	}
+	pkt := socks5.UDPPacket{Addr: addr, Body: p}
 	var buf []byte
-	buf = append(buf, 0, 0, 0) // udp prefix
-	if buf, err = addr.AppendBinary(buf); err == nil {
-		prefixlen := len(buf)
-		buf = append(buf, p...)
-		n, err = c.Conn.Write(buf)
-		n -= prefixlen
-		n = max(n, 0)
+	for err == nil {
+		if frags > 1 {
+			pkt.Body = p[n:min(n+size, len(p))]
+			pkt.Frag++
+			if n+len(pkt.Body) == len(p) {
+				pkt.Frag |= socks5.UDPFragEnd
+			}
+		}
+		if buf, err = pkt.AppendBinary(buf[:0]); err == nil {
+			prefixlen := len(buf) - len(pkt.Body)
+			var nn int
+			nn, err = c.Conn.Write(buf)
+			n += max(nn-prefixlen, 0)
+			if n >= len(p) {
+				break
+			}
+		}
 	}
 	return
 }
 
 func (c *UDPConn) WriteTo(p []byte, netaddr net.Addr) (n int, err error) {
-	var addr socks5.Addr
-	if addr, err = socks5.AddrFromString(netaddr.String()); err == nil {
-		n, err = c.writeTo(p, addr)
+	err = socks5.ErrNoTargetAddress
+	if netaddr != nil {
+		var addr socks5.Addr
+		if addr, err = socks5.AddrFromString(netaddr.String()); err == nil {
+			n, err = c.writeTo(p, addr)
+		}
 	}
 	return
 }
@@ -88,6 +139,15 @@ func (c *UDPConn) Write(b []byte) (int, error) {
 	return c.WriteTo(b, c.targetAddr)
 }
 
+// RemoteAddr returns the target address, or nil if not connected to a target.
 func (c *UDPConn) RemoteAddr() net.Addr {
 	return c.targetAddr
 }
+
+// LocalAddr returns the address the proxy server relays datagrams from.
+func (c *UDPConn) LocalAddr() net.Addr {
+	if c.boundAddr != nil {
+		return c.boundAddr
+	}
+	return c.Conn.LocalAddr()
+}
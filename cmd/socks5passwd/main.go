@@ -0,0 +1,106 @@
+// Command socks5passwd adds, updates or removes users in a htpasswd file
+// used by server.HtpasswdFile.
+//
+// Usage:
+//
+//	socks5passwd [-i iterations] FILE USERNAME    read password from stdin, add or update user
+//	socks5passwd -D FILE USERNAME                 remove user
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linkdata/socks5/server"
+)
+
+var (
+	flagDelete     = flag.Bool("D", false, "remove the user")
+	flagIterations = flag.Int("i", server.DefaultPBKDF2Iterations, "PBKDF2 iterations")
+)
+
+func readUsers(path string) (users map[string]string, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err == nil {
+		defer f.Close()
+		users, err = server.ReadHtpasswd(f)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		users = make(map[string]string)
+		err = nil
+	}
+	return
+}
+
+// writeUsers replaces the file at path atomically, so HtpasswdFile never sees a partial file.
+func writeUsers(path string, users map[string]string) (err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"); err == nil {
+		defer os.Remove(f.Name())
+		if err = f.Chmod(0o600); err == nil {
+			if err = server.WriteHtpasswd(f, users); err == nil {
+				if err = f.Close(); err == nil {
+					err = os.Rename(f.Name(), path)
+				}
+			}
+		}
+		_ = f.Close()
+	}
+	return
+}
+
+func readPassword() (password string, err error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	scanner := bufio.NewScanner(os.Stdin)
+	if scanner.Scan() {
+		password = strings.TrimRight(scanner.Text(), "\r")
+	} else if err = scanner.Err(); err == nil {
+		err = errors.New("no password given")
+	}
+	return
+}
+
+func run(path, username string) (err error) {
+	var users map[string]string
+	if users, err = readUsers(path); err == nil {
+		if *flagDelete {
+			if _, ok := users[username]; !ok {
+				return fmt.Errorf("user %q not found", username)
+			}
+			delete(users, username)
+		} else {
+			if strings.ContainsAny(username, ":\n") {
+				return fmt.Errorf("invalid username %q", username)
+			}
+			var password string
+			if password, err = readPassword(); err == nil {
+				users[username], err = server.HashPassword(password, *flagIterations)
+			}
+		}
+		if err == nil {
+			err = writeUsers(path, users)
+		}
+	}
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-D] [-i iterations] FILE USERNAME\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(flag.Arg(0), flag.Arg(1)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"encoding"
+	"strconv"
+	"strings"
+)
+
+var _ encoding.TextMarshaler = CommandType(0)
+var _ encoding.TextUnmarshaler = (*CommandType)(nil)
+
+var commandTypeText = []string{
+	CommandConnect:   "CONNECT",
+	CommandBind:      "BIND",
+	CommandAssociate: "ASSOCIATE",
+}
+
+func (cmd CommandType) String() string {
+	if int(cmd) < len(commandTypeText) && commandTypeText[cmd] != "" {
+		return commandTypeText[cmd]
+	}
+	return "command(" + strconv.Itoa(int(cmd)) + ")"
+}
+
+func (cmd CommandType) MarshalText() ([]byte, error) {
+	return []byte(cmd.String()), nil
+}
+
+// UnmarshalText parses a command name, ignoring case.
+func (cmd *CommandType) UnmarshalText(text []byte) (err error) {
+	err = ErrUnknownCommand
+	for i, s := range commandTypeText {
+		if s != "" && strings.EqualFold(s, string(text)) {
+			*cmd = CommandType(i)
+			err = nil
+		}
+	}
+	return
+}
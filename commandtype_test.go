@@ -0,0 +1,33 @@
+package socks5_test
+
+import (
+	"testing"
+
+	"github.com/linkdata/socks5"
+)
+
+func TestCommandType_Text(t *testing.T) {
+	for _, cmd := range []socks5.CommandType{socks5.CommandConnect, socks5.CommandBind, socks5.CommandAssociate} {
+		b, err := cmd.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got socks5.CommandType
+		if err = got.UnmarshalText(b); err != nil {
+			t.Error(err)
+		}
+		if got != cmd {
+			t.Error(got, cmd)
+		}
+	}
+	var cmd socks5.CommandType
+	if err := cmd.UnmarshalText([]byte("associate")); err != nil || cmd != socks5.CommandAssociate {
+		t.Error(cmd, err)
+	}
+	if err := cmd.UnmarshalText([]byte("x")); err != socks5.ErrUnknownCommand {
+		t.Error(err)
+	}
+	if x := socks5.CommandType(99).String(); x != "command(99)" {
+		t.Error(x)
+	}
+}
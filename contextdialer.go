@@ -8,3 +8,9 @@ import (
 type ContextDialer interface {
 	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
+
+// PacketListener may be implemented by a ContextDialer to provide packet connections
+// that are not connected to a single address, like net.ListenConfig does.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
@@ -13,8 +13,24 @@ var (
 	ErrAuthFailed              = errors.New("authentication failed")
 	ErrInvalidUDPPacket        = errors.New("invalid udp packet")
 	ErrFragmentedUDPPacket     = errors.New("fragmented udp packet")
+	ErrTooManyFragments        = errors.New("too many udp fragments")
 	ErrNoAcceptableAuthMethods = errors.New("no acceptable auth methods")
 	ErrUnsupportedScheme       = errors.New("unsupported scheme")
+	ErrServerClosed            = errors.New("server closed")
+	ErrUnknownCommand          = errors.New("unknown command")
+	ErrGSSAPIAborted           = errors.New("GSS-API authentication aborted")
+	ErrGSSAPIMessageType       = errors.New("unexpected GSS-API message type")
+	ErrGSSAPIProtectionLevel   = errors.New("unsupported GSS-API protection level")
+	ErrGSSAPITokenTooLong      = errors.New("GSS-API token too long")
+	ErrInvalidToken            = errors.New("invalid token")
+	ErrTokenExpired            = errors.New("token expired")
+	ErrInvalidSocks4Request    = errors.New("invalid SOCKS4 request")
+	ErrSocks4Rejected          = errors.New("SOCKS4 request rejected or failed")
+	ErrSocks4NoIdentd          = errors.New("SOCKS4 request rejected, identd unreachable")
+	ErrSocks4IdentdMismatch    = errors.New("SOCKS4 request rejected, identd user ID mismatch")
+	ErrSocks4IPv6Address       = errors.New("SOCKS4 does not support IPv6 addresses")
+	ErrNoTargetAddress         = errors.New("no target address")
+	ErrTooManyAuthMethods      = errors.New("too many auth methods")
 )
 
 func JoinErrs(errs ...error) (err error) {
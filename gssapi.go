@@ -0,0 +1,160 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync"
+)
+
+// GSS-API message framing (RFC 1961, section 3).
+const (
+	GSSAPIVersion            = 1    // version byte of GSS-API messages
+	GSSAPITypeAuthentication = 1    // security context establishment token
+	GSSAPITypeProtection     = 2    // protection level negotiation
+	GSSAPITypeEncapsulation  = 3    // per-message protected data
+	GSSAPITypeAbort          = 0xff // abort, sent without a length or token
+	GSSAPIMaxTokenLength     = math.MaxUint16
+)
+
+// gssapiMaxChunk is the most data encapsulated in one message, leaving room for mechanism overhead.
+const gssapiMaxChunk = 32 * 1024
+
+// GSSAPIProtection is the per-message protection level negotiated after authentication (RFC 1961, section 4).
+type GSSAPIProtection byte
+
+const (
+	GSSAPIIntegrity       GSSAPIProtection = 1 // required per-message integrity
+	GSSAPIConfidentiality GSSAPIProtection = 2 // required per-message integrity and confidentiality
+	GSSAPISelective       GSSAPIProtection = 3 // selective integrity or confidentiality, treated as confidentiality
+)
+
+// GSSAPIContext is a security context of a GSS-API mechanism, for either the
+// initiating (client) or accepting (server) side.
+type GSSAPIContext interface {
+	// Step processes a token from the peer and returns the token to send to the peer, if any,
+	// and whether the context is established. The initiator's first call has a nil input.
+	Step(input []byte) (output []byte, established bool, err error)
+	// Wrap protects msg for sending to the peer, encrypting it if confidential is true.
+	Wrap(msg []byte, confidential bool) (token []byte, err error)
+	// Unwrap verifies, and if needed decrypts, a token produced by the peer's Wrap.
+	Unwrap(token []byte) (msg []byte, err error)
+	// Principal returns the name of the authenticated peer once the context is established.
+	Principal() string
+}
+
+// GSSAPIMechanism creates security contexts. For initiators, target is the proxy server
+// address. For acceptors, target is the client address.
+type GSSAPIMechanism interface {
+	NewGSSAPIContext(target string) (GSSAPIContext, error)
+}
+
+// WriteGSSAPIMessage writes a GSS-API message of type mtyp with the given token.
+func WriteGSSAPIMessage(w io.Writer, mtyp byte, token []byte) (err error) {
+	b := []byte{GSSAPIVersion, mtyp}
+	if mtyp != GSSAPITypeAbort {
+		err = ErrGSSAPITokenTooLong
+		if len(token) <= GSSAPIMaxTokenLength {
+			err = nil
+			b = binary.BigEndian.AppendUint16(b, uint16(len(token)))
+			b = append(b, token...)
+		}
+	}
+	if err == nil {
+		_, err = w.Write(b)
+	}
+	return
+}
+
+// ReadGSSAPIMessage reads a GSS-API message which must be of type mtyp and returns it's token.
+// If the peer aborted, ErrGSSAPIAborted is returned.
+func ReadGSSAPIMessage(r io.Reader, mtyp byte) (token []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(r, hdr[:]); err == nil {
+		if err = MustEqual(hdr[0], GSSAPIVersion, ErrVersion); err == nil {
+			if err = MustEqual(hdr[1] != GSSAPITypeAbort, true, ErrGSSAPIAborted); err == nil {
+				if err = MustEqual(hdr[1], mtyp, ErrGSSAPIMessageType); err == nil {
+					var length [2]byte
+					if _, err = io.ReadFull(r, length[:]); err == nil {
+						token = make([]byte, binary.BigEndian.Uint16(length[:]))
+						_, err = io.ReadFull(r, token)
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// WriteGSSAPIProtection sends a protection level message.
+func WriteGSSAPIProtection(w io.Writer, gc GSSAPIContext, level GSSAPIProtection) (err error) {
+	var token []byte
+	if token, err = gc.Wrap([]byte{byte(level)}, false); err == nil {
+		err = WriteGSSAPIMessage(w, GSSAPITypeProtection, token)
+	}
+	return
+}
+
+// ReadGSSAPIProtection reads a protection level message.
+func ReadGSSAPIProtection(r io.Reader, gc GSSAPIContext) (level GSSAPIProtection, err error) {
+	var token []byte
+	if token, err = ReadGSSAPIMessage(r, GSSAPITypeProtection); err == nil {
+		var msg []byte
+		if msg, err = gc.Unwrap(token); err == nil {
+			if err = MustEqual(len(msg), 1, ErrGSSAPIProtectionLevel); err == nil {
+				level = GSSAPIProtection(msg[0])
+				if level < GSSAPIIntegrity || level > GSSAPISelective {
+					err = ErrGSSAPIProtectionLevel
+				}
+			}
+		}
+	}
+	return
+}
+
+// GSSAPIConn is a net.Conn that encapsulates all data sent and received
+// using a GSS-API security context (RFC 1961, section 5).
+type GSSAPIConn struct {
+	net.Conn
+	GSSAPIContext
+	Protection GSSAPIProtection
+	rmu        sync.Mutex // protects following
+	rbuf       []byte     // unwrapped data not yet read
+	wmu        sync.Mutex // serializes writes
+}
+
+// NewGSSAPIConn returns a GSSAPIConn using the given security context and negotiated protection level.
+func NewGSSAPIConn(conn net.Conn, gc GSSAPIContext, level GSSAPIProtection) *GSSAPIConn {
+	return &GSSAPIConn{Conn: conn, GSSAPIContext: gc, Protection: level}
+}
+
+func (c *GSSAPIConn) Read(b []byte) (n int, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.rbuf) == 0 && err == nil && len(b) > 0 {
+		var token []byte
+		if token, err = ReadGSSAPIMessage(c.Conn, GSSAPITypeEncapsulation); err == nil {
+			c.rbuf, err = c.Unwrap(token)
+		}
+	}
+	n = copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return
+}
+
+func (c *GSSAPIConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	for len(b) > 0 && err == nil {
+		chunk := b[:min(len(b), gssapiMaxChunk)]
+		var token []byte
+		if token, err = c.Wrap(chunk, c.Protection != GSSAPIIntegrity); err == nil {
+			if err = WriteGSSAPIMessage(c.Conn, GSSAPITypeEncapsulation, token); err == nil {
+				n += len(chunk)
+				b = b[len(chunk):]
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package socks5_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/linkdata/socks5"
+)
+
+// xorContext is a GSSAPIContext that "encrypts" by XOR and has no integrity protection.
+type xorContext struct{}
+
+func (xorContext) Step(input []byte) ([]byte, bool, error) { return nil, true, nil }
+func (xorContext) Principal() string                       { return "xor" }
+
+func (xorContext) Wrap(msg []byte, confidential bool) (token []byte, err error) {
+	token = append([]byte{0}, msg...)
+	if confidential {
+		token[0] = 1
+		for i := 1; i < len(token); i++ {
+			token[i] ^= 0x5a
+		}
+	}
+	return
+}
+
+func (xorContext) Unwrap(token []byte) (msg []byte, err error) {
+	msg = bytes.Clone(token[1:])
+	if token[0] == 1 {
+		for i := range msg {
+			msg[i] ^= 0x5a
+		}
+	}
+	return
+}
+
+func TestGSSAPIMessage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := socks5.WriteGSSAPIMessage(&buf, socks5.GSSAPITypeAuthentication, []byte("tok")); err != nil {
+		t.Fatal(err)
+	}
+	if x := buf.Bytes(); !bytes.Equal(x, []byte{1, 1, 0, 3, 't', 'o', 'k'}) {
+		t.Errorf("%v", x)
+	}
+	if _, err := socks5.ReadGSSAPIMessage(bytes.NewReader(buf.Bytes()), socks5.GSSAPITypeProtection); err != socks5.ErrGSSAPIMessageType {
+		t.Error(err)
+	}
+	tok, err := socks5.ReadGSSAPIMessage(&buf, socks5.GSSAPITypeAuthentication)
+	if err != nil || string(tok) != "tok" {
+		t.Error(string(tok), err)
+	}
+	if err = socks5.WriteGSSAPIMessage(&buf, socks5.GSSAPITypeAbort, []byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+	if x := buf.Bytes(); !bytes.Equal(x, []byte{1, 0xff}) {
+		t.Errorf("%v", x)
+	}
+	if _, err = socks5.ReadGSSAPIMessage(&buf, socks5.GSSAPITypeAuthentication); err != socks5.ErrGSSAPIAborted {
+		t.Error(err)
+	}
+	if err = socks5.WriteGSSAPIMessage(&buf, socks5.GSSAPITypeAuthentication, make([]byte, 65536)); err != socks5.ErrGSSAPITokenTooLong {
+		t.Error(err)
+	}
+}
+
+func TestGSSAPIProtection(t *testing.T) {
+	var buf bytes.Buffer
+	if err := socks5.WriteGSSAPIProtection(&buf, xorContext{}, socks5.GSSAPIConfidentiality); err != nil {
+		t.Fatal(err)
+	}
+	level, err := socks5.ReadGSSAPIProtection(&buf, xorContext{})
+	if err != nil || level != socks5.GSSAPIConfidentiality {
+		t.Error(level, err)
+	}
+	if err = socks5.WriteGSSAPIProtection(&buf, xorContext{}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = socks5.ReadGSSAPIProtection(&buf, xorContext{}); err != socks5.ErrGSSAPIProtectionLevel {
+		t.Error(err)
+	}
+}
+
+func TestGSSAPIConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ca := socks5.NewGSSAPIConn(a, xorContext{}, socks5.GSSAPIConfidentiality)
+	cb := socks5.NewGSSAPIConn(b, xorContext{}, socks5.GSSAPIConfidentiality)
+
+	want := bytes.Repeat([]byte("0123456789"), 10000)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ca.Write(want)
+		errc <- errors.Join(err, ca.Close())
+	}()
+	got, err := io.ReadAll(cb)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = <-errc; err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error(len(got), len(want))
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthHMAC sub-negotiation, after the server selects the method:
+//
+//	client: AuthPrivateVersion, ULEN, USERNAME
+//	server: AuthPrivateVersion, CHALLENGE (HMACChallengeSize bytes)
+//	client: AuthPrivateVersion, RESPONSE (sha256.Size bytes, see HMACResponse)
+//	server: AuthPrivateVersion, AuthSuccess or AuthFailure
+//
+// AuthToken sub-negotiation, after the server selects the method:
+//
+//	client: AuthPrivateVersion, TLEN (2 bytes, big endian), TOKEN (see SignToken)
+//	server: AuthPrivateVersion, AuthSuccess or AuthFailure
+
+// HMACResponse returns the response to an AuthHMAC challenge, which is the
+// HMAC-SHA256 keyed with the shared secret over the challenge followed by the username.
+func HMACResponse(secret []byte, username string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
+func tokenSignature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignToken returns an AuthToken bearer token for username that is valid until expires.
+//
+// The token is the base64url encoded username, a dot, the expiry time in Unix seconds,
+// a dot and the base64url encoded HMAC-SHA256 of what precedes it, keyed with key.
+func SignToken(key []byte, username string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(username)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + tokenSignature(key, payload)
+}
+
+// VerifyToken checks a token made by SignToken and returns the username from it.
+// Returns ErrInvalidToken if the token is malformed or the signature doesn't match,
+// and ErrTokenExpired if it is no longer valid at the time now.
+func VerifyToken(key []byte, token string, now time.Time) (username string, err error) {
+	err = ErrInvalidToken
+	if i := strings.LastIndexByte(token, '.'); i > 0 {
+		payload := token[:i]
+		if hmac.Equal([]byte(token[i+1:]), []byte(tokenSignature(key, payload))) {
+			if user, expires, ok := strings.Cut(payload, "."); ok {
+				var b []byte
+				if b, err = base64.RawURLEncoding.DecodeString(user); err == nil {
+					var unix int64
+					if unix, err = strconv.ParseInt(expires, 10, 64); err == nil {
+						if err = MustEqual(now.Before(time.Unix(unix, 0)), true, ErrTokenExpired); err == nil {
+							username = string(b)
+						}
+					}
+				}
+				if err != nil && err != ErrTokenExpired {
+					err = ErrInvalidToken
+				}
+			}
+		}
+	}
+	return
+}
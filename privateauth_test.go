@@ -0,0 +1,45 @@
+package socks5_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+func TestHMACResponse(t *testing.T) {
+	challenge := bytes.Repeat([]byte{1}, socks5.HMACChallengeSize)
+	a := socks5.HMACResponse([]byte("secret"), "u", challenge)
+	if !bytes.Equal(a, socks5.HMACResponse([]byte("secret"), "u", challenge)) {
+		t.Error("not deterministic")
+	}
+	if bytes.Equal(a, socks5.HMACResponse([]byte("secret"), "v", challenge)) {
+		t.Error("username not included")
+	}
+	if bytes.Equal(a, socks5.HMACResponse([]byte("other"), "u", challenge)) {
+		t.Error("secret not included")
+	}
+}
+
+func TestSignToken(t *testing.T) {
+	key := []byte("key")
+	now := time.Now()
+	token := socks5.SignToken(key, "joe.user", now.Add(time.Minute))
+	if username, err := socks5.VerifyToken(key, token, now); err != nil || username != "joe.user" {
+		t.Error(username, err)
+	}
+	if _, err := socks5.VerifyToken(key, token, now.Add(time.Hour)); err != socks5.ErrTokenExpired {
+		t.Error(err)
+	}
+	if _, err := socks5.VerifyToken([]byte("other"), token, now); err != socks5.ErrInvalidToken {
+		t.Error(err)
+	}
+	tampered := strings.Replace(token, ".", "x.", 1)
+	for _, s := range []string{"", ".", "a.b", "a.b.c", tampered} {
+		if _, err := socks5.VerifyToken(key, s, now); err != socks5.ErrInvalidToken {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// AccountingRecord describes the traffic relayed for a session.
+type AccountingRecord struct {
+	Username  string             // username, empty string if anonymous (AuthMethodNone)
+	Source    string             // client network address
+	Command   socks5.CommandType // requested command
+	Target    string             // address from the client request
+	Started   time.Time          // when the request was received
+	Duration  time.Duration      // time since Started
+	BytesUp   int64              // bytes relayed from the client to targets
+	BytesDown int64              // bytes relayed from targets to the client
+	Final     bool               // true if the session has ended, false for interim updates
+}
+
+// Accounter receives traffic accounting records.
+type Accounter interface {
+	// Account is called when a session ends, and every Server.AccountingInterval while it is active.
+	// Byte counts are totals since the session started. It must not block.
+	Account(rec *AccountingRecord)
+}
+
+func (sess *session) accountingRecord(final bool) *AccountingRecord {
+	return &AccountingRecord{
+		Username:  sess.username,
+		Source:    sess.conn.RemoteAddr().String(),
+		Command:   sess.cmd,
+		Target:    sess.target,
+		Started:   sess.started,
+		Duration:  time.Since(sess.started),
+		BytesUp:   sess.bytesUp.Load(),
+		BytesDown: sess.bytesDown.Load(),
+		Final:     final,
+	}
+}
+
+// startAccounting starts interim accounting updates if needed. The returned
+// function stops them and sends the final record.
+func (sess *session) startAccounting() (stop func()) {
+	stop = func() {}
+	if sess.Accounter != nil {
+		done := make(chan struct{})
+		if sess.AccountingInterval > 0 {
+			go func() {
+				tmr := time.NewTicker(sess.AccountingInterval)
+				defer tmr.Stop()
+				for {
+					select {
+					case <-done:
+						return
+					case <-tmr.C:
+						sess.Accounter.Account(sess.accountingRecord(false))
+					}
+				}
+			}()
+		}
+		stop = func() {
+			close(done)
+			sess.Accounter.Account(sess.accountingRecord(true))
+		}
+	}
+	return
+}
@@ -0,0 +1,211 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type recordingAccounter struct {
+	mu      sync.Mutex
+	records []server.AccountingRecord
+}
+
+func (ra *recordingAccounter) Account(rec *server.AccountingRecord) {
+	ra.mu.Lock()
+	ra.records = append(ra.records, *rec)
+	ra.mu.Unlock()
+}
+
+func (ra *recordingAccounter) final(ctx context.Context) (rec server.AccountingRecord) {
+	for ctx.Err() == nil {
+		ra.mu.Lock()
+		for _, r := range ra.records {
+			if r.Final {
+				rec = r
+			}
+		}
+		ra.mu.Unlock()
+		if rec.Final {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+// interim returns the latest interim record, if any.
+func (ra *recordingAccounter) interim() (rec server.AccountingRecord, ok bool) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for _, r := range ra.records {
+		if !r.Final {
+			rec, ok = r, true
+		}
+	}
+	return
+}
+
+// startUDPServer starts a UDP server that answers each datagram with what reply returns for it.
+func startUDPServer(t *testing.T, reply func(b []byte, addr net.Addr) []byte) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(reply(buf[:n], addr), addr)
+		}
+	}()
+	return pc
+}
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	t.Helper()
+	return startUDPServer(t, func(b []byte, addr net.Addr) []byte { return b })
+}
+
+func TestServer_Accounter_Connect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	acct := &recordingAccounter{}
+	srv := &server.Server{
+		Authenticators:     []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+		Accounter:          acct,
+		AccountingInterval: time.Millisecond * 10,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if rec, ok := acct.interim(); !ok || rec.BytesUp != 5 || rec.BytesDown != 5 {
+		t.Errorf("%v %+v", ok, rec)
+	}
+	_ = conn.Close()
+
+	rec := acct.final(ctx)
+	if rec.Username != "u" || rec.Command != socks5.CommandConnect || rec.Target != echo.Addr().String() {
+		t.Errorf("%+v", rec)
+	}
+	if rec.BytesUp != 5 || rec.BytesDown != 5 {
+		t.Errorf("%+v", rec)
+	}
+	if rec.Duration < time.Millisecond*50 {
+		t.Error(rec.Duration)
+	}
+}
+
+func TestServer_Accounter_Associate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	acct := &recordingAccounter{}
+	listen := startServer(t, ctx, &server.Server{Accounter: acct})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	rec := acct.final(ctx)
+	if rec.Command != socks5.CommandAssociate || rec.BytesUp != 5 || rec.BytesDown != 5 {
+		t.Errorf("%+v", rec)
+	}
+}
+
+func TestServer_Accounter_BothDirections(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// the target ends the download direction at once, while the client keeps uploading
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.(*net.TCPConn).CloseWrite()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	acct := &recordingAccounter{}
+	listen := startServer(t, ctx, &server.Server{Accounter: acct})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	rec := acct.final(ctx)
+	if n := <-received; rec.BytesUp != n {
+		t.Error(rec.BytesUp, n)
+	}
+}
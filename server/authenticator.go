@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"io"
 
 	"github.com/linkdata/socks5"
@@ -17,6 +18,12 @@ type Authenticator interface {
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
+var _ ContextAuthenticator = NoAuthAuthenticator{}
+
+func (a NoAuthAuthenticator) Socks5AuthenticateContext(_ context.Context, info *ConnInfo, am socks5.AuthMethod) (*Identity, error) {
+	return usernameIdentity(a.Socks5Authenticate(info.Conn, am, info.RemoteAddr.String()))
+}
+
 func (a NoAuthAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, _ string) (username string, err error) {
 	err = socks5.ErrAuthMethodNotSupported
 	if am == socks5.AuthMethodNone {
@@ -30,7 +37,17 @@ type UserPassAuthenticator struct {
 	Credentials CredentialsValidator
 }
 
+var _ ContextAuthenticator = UserPassAuthenticator{}
+
+func (a UserPassAuthenticator) Socks5AuthenticateContext(ctx context.Context, info *ConnInfo, am socks5.AuthMethod) (*Identity, error) {
+	return usernameIdentity(a.authenticate(ctx, info.Conn, am, info.RemoteAddr.String()))
+}
+
 func (a UserPassAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
+	return a.authenticate(context.Background(), rw, am, address)
+}
+
+func (a UserPassAuthenticator) authenticate(ctx context.Context, rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
 	err = socks5.ErrAuthMethodNotSupported
 	if am == socks5.AuthUserPass {
 		resultcode := byte(socks5.AuthFailure)
@@ -48,7 +65,7 @@ func (a UserPassAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.Au
 							if _, err = io.ReadFull(rw, pwdBytes); err == nil {
 								usr := string(usrBytes)
 								err = socks5.ErrAuthFailed
-								if a.Credentials.ValidateCredentials(usr, string(pwdBytes), address) {
+								if validateCredentials(ctx, a.Credentials, usr, string(pwdBytes), address) {
 									err = nil
 									resultcode = socks5.AuthSuccess
 									username = usr
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+
+	"github.com/linkdata/socks5"
+)
+
+// CertificateAuthenticator authenticates clients by their verified TLS client certificate.
+//
+// The Server must be serving a TLS listener (see crypto/tls.NewListener) whose
+// tls.Config verifies client certificates, using tls.RequireAndVerifyClientCert or
+// tls.VerifyClientCertIfGiven. Clients use the "No Authentication" method, which this
+// authenticator accepts only if a verified client certificate was presented. List it
+// before NoAuthAuthenticator, if that is used at all.
+//
+// By default, the username is the certificate subject common name and the groups are
+// the subject organizational units.
+type CertificateAuthenticator struct {
+	// Identity, if not nil, maps the verified client certificate to an Identity.
+	// Returning nil declines the client, leaving it to the next Authenticator.
+	Identity func(cert *x509.Certificate) *Identity
+}
+
+var _ ContextAuthenticator = CertificateAuthenticator{}
+
+// Socks5Authenticate always returns socks5.ErrAuthMethodNotSupported, since the TLS
+// state is needed. See Socks5AuthenticateContext.
+func (a CertificateAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
+	return "", socks5.ErrAuthMethodNotSupported
+}
+
+func (a CertificateAuthenticator) identity(cert *x509.Certificate) (id *Identity) {
+	if a.Identity != nil {
+		return a.Identity(cert)
+	}
+	if cert.Subject.CommonName != "" {
+		id = &Identity{
+			Username:   cert.Subject.CommonName,
+			Groups:     cert.Subject.OrganizationalUnit,
+			Attributes: map[string]string{"subject": cert.Subject.String()},
+		}
+	}
+	return
+}
+
+func (a CertificateAuthenticator) Socks5AuthenticateContext(_ context.Context, info *ConnInfo, am socks5.AuthMethod) (id *Identity, err error) {
+	err = socks5.ErrAuthMethodNotSupported
+	if am == socks5.AuthMethodNone && info.TLS != nil && len(info.TLS.VerifiedChains) > 0 {
+		if id = a.identity(info.TLS.VerifiedChains[0][0]); id != nil {
+			_, err = info.Conn.Write([]byte{socks5.Socks5Version, byte(am)})
+		}
+	}
+	if err != nil {
+		id = nil
+	}
+	return
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/linkdata/socks5"
+)
+
+// ConnInfo describes the client connection being authenticated.
+type ConnInfo struct {
+	Conn       net.Conn             // client connection, a ContextAuthenticator may replace it to encapsulate the session
+	LocalAddr  net.Addr             // address the client connected to
+	RemoteAddr net.Addr             // client address
+	TLS        *tls.ConnectionState // TLS connection state, nil if the client did not connect using TLS
+}
+
+// Identity describes an authenticated client.
+type Identity struct {
+	Username   string            // empty if anonymous
+	Groups     []string          // groups the user belongs to, if known
+	Attributes map[string]string // other information provided by the authenticator
+}
+
+// ContextAuthenticator is an Authenticator that is given a context and information about
+// the connection, and returns an Identity. If an Authenticator implements ContextAuthenticator,
+// the Server calls Socks5AuthenticateContext instead of Socks5Authenticate.
+type ContextAuthenticator interface {
+	Authenticator
+	// Socks5AuthenticateContext authenticates the client using info.Conn. Return socks5.ErrAuthMethodNotSupported
+	// if the method is not supported by the authenticator. On success, the returned Identity must not be nil.
+	// The context is cancelled when the session ends.
+	Socks5AuthenticateContext(ctx context.Context, info *ConnInfo, am socks5.AuthMethod) (id *Identity, err error)
+}
+
+// usernameIdentity returns an Identity with only the username set, or nil if err is not nil.
+func usernameIdentity(username string, err error) (id *Identity, _ error) {
+	if err == nil {
+		id = &Identity{Username: username}
+	}
+	return id, err
+}
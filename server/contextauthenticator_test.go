@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+// groupAuthenticator adds groups and connection details to the Identity from UserPassAuthenticator.
+type groupAuthenticator struct {
+	server.UserPassAuthenticator
+}
+
+func (a groupAuthenticator) Socks5AuthenticateContext(ctx context.Context, info *server.ConnInfo, am socks5.AuthMethod) (id *server.Identity, err error) {
+	if id, err = a.UserPassAuthenticator.Socks5AuthenticateContext(ctx, info, am); err == nil {
+		id.Groups = []string{"staff"}
+		id.Attributes = map[string]string{
+			"local":  info.LocalAddr.String(),
+			"remote": info.RemoteAddr.String(),
+		}
+	}
+	return
+}
+
+// legacyAuthenticator only implements the original Authenticator interface.
+type legacyAuthenticator struct {
+	auth server.Authenticator
+}
+
+func (a legacyAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (string, error) {
+	return a.auth.Socks5Authenticate(rw, am, address)
+}
+
+type identityDialerSelector struct {
+	mu  sync.Mutex
+	ids []*server.Identity
+}
+
+func (ids *identityDialerSelector) SelectDialer(username, network, address string) (socks5.ContextDialer, error) {
+	panic("SelectDialer called")
+}
+
+func (ids *identityDialerSelector) SelectDialerIdentity(id *server.Identity, network, address string) (socks5.ContextDialer, error) {
+	ids.mu.Lock()
+	ids.ids = append(ids.ids, id)
+	ids.mu.Unlock()
+	return nil, nil
+}
+
+func TestServer_ContextAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	selector := &identityDialerSelector{}
+	reh := &recordingEventHandler{}
+	creds := server.StaticCredentials{"u": "p"}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{groupAuthenticator{server.UserPassAuthenticator{Credentials: creds}}},
+		DialerSelector: selector,
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	if conn, err = cli.DialContext(ctx, "tcp", echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	events := reh.closed(ctx)
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	if len(selector.ids) != 1 {
+		t.Fatal(selector.ids)
+	}
+	id := selector.ids[0]
+	if id.Username != "u" || len(id.Groups) != 1 || id.Groups[0] != "staff" {
+		t.Errorf("%+v", id)
+	}
+	if id.Attributes["remote"] != local || id.Attributes["local"] != listen.Addr().String() {
+		t.Errorf("%+v", id)
+	}
+	for _, ev := range events {
+		if ev.Type >= server.EventAuthResult && ev.Identity != id {
+			t.Errorf("%v: %+v", ev.Type, ev.Identity)
+		}
+	}
+}
+
+func TestServer_LegacyAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	selector := &identityDialerSelector{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{legacyAuthenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}}},
+		DialerSelector: selector,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	if err := dialEcho(ctx, t, "socks5h://u:p@"+listen.Addr().String(), echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialEcho(ctx, t, "socks5h://u:x@"+listen.Addr().String(), echo.Addr().String()); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	if len(selector.ids) != 1 || selector.ids[0].Username != "u" {
+		t.Errorf("%+v", selector.ids)
+	}
+}
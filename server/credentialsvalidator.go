@@ -1,14 +1,43 @@
 package server
 
+import (
+	"context"
+	"crypto/subtle"
+)
+
 // CredentialsValidator is used to support user/pass authentication optional network address filtering.
 type CredentialsValidator interface {
 	ValidateCredentials(username, password, address string) bool
 }
 
-// StaticCredentials enables using a map directly as a credential store
+// ContextCredentialsValidator is a CredentialsValidator that is given the session context,
+// which is cancelled when the session ends. UserPassAuthenticator uses it if implemented.
+type ContextCredentialsValidator interface {
+	CredentialsValidator
+	ValidateCredentialsContext(ctx context.Context, username, password, address string) bool
+}
+
+// validateCredentials calls cv.ValidateCredentialsContext if implemented, else cv.ValidateCredentials.
+func validateCredentials(ctx context.Context, cv CredentialsValidator, username, password, address string) bool {
+	if ccv, ok := cv.(ContextCredentialsValidator); ok {
+		return ccv.ValidateCredentialsContext(ctx, username, password, address)
+	}
+	return cv.ValidateCredentials(username, password, address)
+}
+
+// StaticCredentials enables using a map directly as a credential store.
+// Passwords are compared in constant time, but stored in plain text; see HtpasswdFile.
 type StaticCredentials map[string]string
 
 func (s StaticCredentials) ValidateCredentials(username, password, _ string) bool {
 	pass, ok := s[username]
-	return ok && password == pass
+	return subtle.ConstantTimeCompare([]byte(password), []byte(pass)) == 1 && ok
+}
+
+func (s StaticCredentials) LookupSecret(username, _ string) (secret []byte, ok bool) {
+	var pass string
+	if pass, ok = s[username]; ok {
+		secret = []byte(pass)
+	}
+	return
 }
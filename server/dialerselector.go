@@ -1,6 +1,10 @@
 package server
 
-import "github.com/linkdata/socks5"
+import (
+	"time"
+
+	"github.com/linkdata/socks5"
+)
 
 // A socks5.DialerSelector returns the ContextDialer to use.
 type DialerSelector interface {
@@ -11,3 +15,19 @@ type DialerSelector interface {
 	// as those will be mapped to SOCKS5 error codes in the reply to the client.
 	SelectDialer(username, network, address string) (cd socks5.ContextDialer, err error)
 }
+
+// IdentityDialerSelector may optionally be implemented by a DialerSelector to select
+// the ContextDialer using the full Identity from authentication. If implemented,
+// it is called instead of SelectDialer.
+type IdentityDialerSelector interface {
+	// SelectDialerIdentity returns the ContextDialer to use. The Identity is never nil,
+	// but it's Username is the empty string if AuthMethodNone was used.
+	SelectDialerIdentity(id *Identity, network, address string) (cd socks5.ContextDialer, err error)
+}
+
+// DialTimeoutSelector may optionally be implemented by a DialerSelector
+// to override Server.DialTimeout for individual requests.
+type DialTimeoutSelector interface {
+	// SelectDialTimeout returns the dial timeout to use. If it returns zero, Server.DialTimeout is used.
+	SelectDialTimeout(username, network, address string) time.Duration
+}
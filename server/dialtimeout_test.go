@@ -0,0 +1,101 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type blockingDialer struct {
+	started chan time.Time
+}
+
+func (d blockingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.started <- time.Now()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type timeoutSelector struct {
+	dialer  socks5.ContextDialer
+	timeout time.Duration
+}
+
+func (ts timeoutSelector) SelectDialer(username, network, address string) (socks5.ContextDialer, error) {
+	return ts.dialer, nil
+}
+
+func (ts timeoutSelector) SelectDialTimeout(username, network, address string) time.Duration {
+	return ts.timeout
+}
+
+func dialTimeout(t *testing.T, srv *server.Server, started chan time.Time) time.Duration {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cli.DialContext(ctx, "tcp", "192.0.2.1:80")
+	if !errors.Is(err, socks5.ErrReplyTTLExpired) {
+		t.Error(err)
+	}
+	return time.Since(<-started)
+}
+
+func TestServer_DialTimeout(t *testing.T) {
+	started := make(chan time.Time, 1)
+	srv := &server.Server{
+		DialerSelector: timeoutSelector{dialer: blockingDialer{started}},
+		DialTimeout:    time.Millisecond * 50,
+	}
+	if elapsed := dialTimeout(t, srv, started); elapsed > time.Second {
+		t.Error(elapsed)
+	}
+}
+
+func TestServer_DialTimeout_Selector(t *testing.T) {
+	started := make(chan time.Time, 1)
+	srv := &server.Server{
+		DialerSelector: timeoutSelector{dialer: blockingDialer{started}, timeout: time.Millisecond * 50},
+		DialTimeout:    time.Hour,
+	}
+	if elapsed := dialTimeout(t, srv, started); elapsed > time.Second {
+		t.Error(elapsed)
+	}
+}
+
+func TestServer_ConnectionRefused(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// find a port that nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	_ = closed.Close()
+
+	listen := startServer(t, ctx, &server.Server{})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", addr); !errors.Is(err, socks5.ErrReplyConnectionRefused) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// EventType identifies a session lifecycle event.
+type EventType byte
+
+const (
+	EventGreeting    EventType = iota + 1 // client greeting received, AuthMethods is set
+	EventAuthChosen                       // authentication method chosen, AuthMethod is set
+	EventAuthResult                       // authentication finished, AuthMethod, Identity and Err are set
+	EventRequest                          // request received, Command and Target are set
+	EventDialStart                        // outgoing connection being dialed, Network and Address are set
+	EventDialDone                         // outgoing connection dialed, Network, Address and Err are set
+	EventReply                            // reply sent to the client, Reply and Address are set
+	EventClose                            // session closed, Err is set
+	EventAuthLockout                      // ThrottledCredentials locked out a username or source, Address is the key
+)
+
+var eventTypeText = []string{
+	EventGreeting:    "greeting",
+	EventAuthChosen:  "auth-chosen",
+	EventAuthResult:  "auth-result",
+	EventRequest:     "request",
+	EventDialStart:   "dial-start",
+	EventDialDone:    "dial-done",
+	EventReply:       "reply",
+	EventClose:       "close",
+	EventAuthLockout: "auth-lockout",
+}
+
+func (et EventType) String() string {
+	if int(et) < len(eventTypeText) && eventTypeText[et] != "" {
+		return eventTypeText[et]
+	}
+	return "event(" + strconv.Itoa(int(et)) + ")"
+}
+
+// Event describes something that happened during a session.
+//
+// SessionID, Time, RemoteAddr, Username, Command and Target are set for all
+// events as soon as they are known. Other fields depend on the Type.
+type Event struct {
+	Type        EventType
+	SessionID   uint64             // unique per Server, the same for all events of a session
+	Time        time.Time          // when the event happened
+	RemoteAddr  net.Addr           // client address
+	Username    string             // authenticated username, empty if anonymous or not yet authenticated
+	Identity    *Identity          // authenticated identity, nil if not yet authenticated
+	Command     socks5.CommandType // requested command, zero before EventRequest
+	Target      string             // address from the client request, empty before EventRequest
+	AuthMethods []socks5.AuthMethod
+	AuthMethod  socks5.AuthMethod
+	Network     string
+	Address     string
+	Reply       socks5.ReplyCode
+	Err         error
+}
+
+// EventHandler receives session lifecycle events.
+//
+// HandleEvent is called synchronously from the session's goroutine, so it should not block.
+// The Event must not be retained after HandleEvent returns.
+type EventHandler interface {
+	HandleEvent(ev *Event)
+}
+
+// emit fills in the common fields of ev and passes it to the EventHandler, if any.
+func (sess *session) emit(ev Event) {
+	if sess.EventHandler != nil {
+		ev.SessionID = sess.id
+		ev.Time = time.Now()
+		ev.RemoteAddr = sess.conn.RemoteAddr()
+		if ev.Username == "" {
+			ev.Username = sess.username
+		}
+		if ev.Identity == nil {
+			ev.Identity = sess.identity
+		}
+		ev.Command = sess.cmd
+		ev.Target = sess.target
+		sess.EventHandler.HandleEvent(&ev)
+	}
+}
@@ -0,0 +1,176 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type recordingEventHandler struct {
+	mu     sync.Mutex
+	events []server.Event
+}
+
+func (reh *recordingEventHandler) HandleEvent(ev *server.Event) {
+	reh.mu.Lock()
+	reh.events = append(reh.events, *ev)
+	reh.mu.Unlock()
+}
+
+func (reh *recordingEventHandler) closed(ctx context.Context) (events []server.Event) {
+	for ctx.Err() == nil {
+		reh.mu.Lock()
+		events = slices.Clone(reh.events)
+		reh.mu.Unlock()
+		if len(events) > 0 && events[len(events)-1].Type == server.EventClose {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+func TestServer_EventHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	reh := &recordingEventHandler{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	events := reh.closed(ctx)
+	var types []server.EventType
+	for _, ev := range events {
+		types = append(types, ev.Type)
+		if ev.SessionID != events[0].SessionID || ev.SessionID == 0 {
+			t.Errorf("%v: session ID %v", ev.Type, ev.SessionID)
+		}
+		if ev.RemoteAddr == nil || ev.Time.IsZero() {
+			t.Errorf("%+v", ev)
+		}
+		if ev.Type >= server.EventAuthResult && ev.Username != "u" {
+			t.Errorf("%v: username %q", ev.Type, ev.Username)
+		}
+		if ev.Type >= server.EventRequest && (ev.Command != socks5.CommandConnect || ev.Target != echo.Addr().String()) {
+			t.Errorf("%v: %v %q", ev.Type, ev.Command, ev.Target)
+		}
+	}
+	want := []server.EventType{
+		server.EventGreeting,
+		server.EventAuthChosen,
+		server.EventAuthResult,
+		server.EventRequest,
+		server.EventDialStart,
+		server.EventDialDone,
+		server.EventReply,
+		server.EventClose,
+	}
+	if !slices.Equal(types, want) {
+		t.Errorf("\n got %v\nwant %v", types, want)
+	}
+	if ev := events[len(events)-1]; ev.Err != nil {
+		t.Error(ev.Err)
+	}
+}
+
+func TestServer_EventHandler_AuthFailed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	reh := &recordingEventHandler{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("expected error")
+	}
+	events := reh.closed(ctx)
+	if len(events) != 4 || events[2].Type != server.EventAuthResult || events[2].AuthMethod != socks5.AuthUserPass || events[2].Err == nil {
+		t.Errorf("%+v", events)
+	}
+}
+
+func TestEventType_String(t *testing.T) {
+	if s := server.EventDialDone.String(); s != "dial-done" {
+		t.Error(s)
+	}
+	if s := server.EventType(99).String(); s != "event(99)" {
+		t.Error(s)
+	}
+}
+
+type chosenCheckingCredentials struct {
+	reh    *recordingEventHandler
+	chosen bool
+}
+
+func (ccc *chosenCheckingCredentials) ValidateCredentials(username, password, address string) bool {
+	ccc.reh.mu.Lock()
+	defer ccc.reh.mu.Unlock()
+	for _, ev := range ccc.reh.events {
+		ccc.chosen = ccc.chosen || ev.Type == server.EventAuthChosen
+	}
+	return username == "u" && password == "p"
+}
+
+func TestServer_EventHandler_AuthChosenFirst(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	reh := &recordingEventHandler{}
+	creds := &chosenCheckingCredentials{reh: reh}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: creds}},
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cli.DialContext(ctx, "tcp", "127.0.0.1:1")
+	reh.closed(ctx)
+	if !creds.chosen {
+		t.Error("EventAuthChosen not emitted before the credentials were validated")
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+	"time"
+)
+
+// FileCheckInterval is how often files loaded by RuleFile and HtpasswdFile are checked for changes.
+var FileCheckInterval = time.Second
+
+// fileWatcher detects changes to a file by comparing modification time and size.
+type fileWatcher struct {
+	checked time.Time // when we last checked the file
+	modTime time.Time
+	size    int64
+}
+
+// changed returns true if the file at path was modified since the last time changed returned true.
+// Unless force is set, the file is checked at most once every FileCheckInterval.
+func (fw *fileWatcher) changed(path string, force bool) (yes bool, err error) {
+	now := time.Now()
+	if force || now.Sub(fw.checked) >= FileCheckInterval {
+		fw.checked = now
+		var fi os.FileInfo
+		if fi, err = os.Stat(path); err == nil {
+			if yes = force || !fi.ModTime().Equal(fw.modTime) || fi.Size() != fw.size; yes {
+				fw.modTime = fi.ModTime()
+				fw.size = fi.Size()
+			}
+		}
+	}
+	return
+}
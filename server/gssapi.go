@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/linkdata/socks5"
+)
+
+// GSSAPIAuthenticator is used to handle GSS-API authentication (RFC 1961).
+//
+// The username is the principal name of the authenticated client. After authentication,
+// the rest of the session is encapsulated according to the negotiated protection level.
+// UDP datagrams relayed for ASSOCIATE are not encapsulated.
+type GSSAPIAuthenticator struct {
+	Mechanism     socks5.GSSAPIMechanism  // creates the accepting security context for each session
+	MinProtection socks5.GSSAPIProtection // lowest protection level accepted, zero for socks5.GSSAPIIntegrity
+}
+
+var _ ContextAuthenticator = GSSAPIAuthenticator{}
+
+// Socks5Authenticate always returns socks5.ErrAuthMethodNotSupported, since GSS-API
+// authentication requires replacing the connection. See Socks5AuthenticateContext.
+func (a GSSAPIAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
+	return "", socks5.ErrAuthMethodNotSupported
+}
+
+// Socks5AuthenticateContext authenticates the client and replaces info.Conn with a socks5.GSSAPIConn.
+// The Identity has the principal name as Username, and the "gssapi-protection" attribute set to the
+// negotiated protection level.
+func (a GSSAPIAuthenticator) Socks5AuthenticateContext(_ context.Context, info *ConnInfo, am socks5.AuthMethod) (id *Identity, err error) {
+	conn := info.Conn
+	address := info.RemoteAddr.String()
+	err = socks5.ErrAuthMethodNotSupported
+	if am == socks5.AuthGSSAPI && a.Mechanism != nil {
+		if _, err = conn.Write([]byte{socks5.Socks5Version, byte(am)}); err == nil {
+			var gc socks5.GSSAPIContext
+			if gc, err = a.Mechanism.NewGSSAPIContext(address); err == nil {
+				var established bool
+				for err == nil && !established {
+					var input, output []byte
+					if input, err = socks5.ReadGSSAPIMessage(conn, socks5.GSSAPITypeAuthentication); err == nil {
+						if output, established, err = gc.Step(input); err == nil {
+							err = socks5.WriteGSSAPIMessage(conn, socks5.GSSAPITypeAuthentication, output)
+						}
+					}
+				}
+				var level socks5.GSSAPIProtection
+				if err == nil {
+					if level, err = socks5.ReadGSSAPIProtection(conn, gc); err == nil {
+						level = max(level, a.MinProtection)
+						if err = socks5.WriteGSSAPIProtection(conn, gc, level); err == nil {
+							info.Conn = socks5.NewGSSAPIConn(conn, gc, level)
+							id = &Identity{
+								Username:   gc.Principal(),
+								Attributes: map[string]string{"gssapi-protection": strconv.Itoa(int(level))},
+							}
+						}
+					}
+				}
+			}
+			if err != nil {
+				if err != socks5.ErrGSSAPIAborted {
+					_ = socks5.WriteGSSAPIMessage(conn, socks5.GSSAPITypeAbort, nil)
+				}
+				err = socks5.JoinErrs(socks5.ErrAuthFailed, err)
+			}
+		}
+	}
+	return
+}
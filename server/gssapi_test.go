@@ -0,0 +1,231 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+var errTestGSSAPI = errors.New("test GSS-API mechanism failure")
+
+// testGSSAPIMechanism is a stand-in for a real mechanism like Kerberos. The initiator
+// sends it's principal name, and the acceptor accepts any name except "bad".
+type testGSSAPIMechanism struct {
+	initiator bool
+	principal string
+}
+
+func (m testGSSAPIMechanism) NewGSSAPIContext(target string) (socks5.GSSAPIContext, error) {
+	return &testGSSAPIContext{initiator: m.initiator, principal: m.principal}, nil
+}
+
+type testGSSAPIContext struct {
+	initiator bool
+	principal string
+	steps     int
+}
+
+func (gc *testGSSAPIContext) Step(input []byte) (output []byte, established bool, err error) {
+	gc.steps++
+	switch {
+	case gc.initiator && gc.steps == 1:
+		output = []byte("init:" + gc.principal)
+	case gc.initiator && gc.steps == 2:
+		established = string(input) == "accept"
+	case !gc.initiator && strings.HasPrefix(string(input), "init:"):
+		if gc.principal = strings.TrimPrefix(string(input), "init:"); gc.principal != "bad" {
+			output = []byte("accept")
+			established = true
+		}
+	}
+	if output == nil && !established {
+		err = errTestGSSAPI
+	}
+	return
+}
+
+func (gc *testGSSAPIContext) Principal() string {
+	return gc.principal
+}
+
+func (gc *testGSSAPIContext) Wrap(msg []byte, confidential bool) (token []byte, err error) {
+	token = binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(msg))
+	token = append(token, msg...)
+	if confidential {
+		token = append([]byte{1}, token...)
+		for i := 1; i < len(token); i++ {
+			token[i] ^= 0xa5
+		}
+	} else {
+		token = append([]byte{0}, token...)
+	}
+	return
+}
+
+func (gc *testGSSAPIContext) Unwrap(token []byte) (msg []byte, err error) {
+	err = errTestGSSAPI
+	if len(token) >= 5 {
+		token = bytes.Clone(token)
+		if token[0] == 1 {
+			for i := 1; i < len(token); i++ {
+				token[i] ^= 0xa5
+			}
+		}
+		if msg = token[5:]; bytes.Equal(token[1:5], binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(msg))) {
+			err = nil
+		}
+	}
+	return
+}
+
+// sniffingDialer records what the client writes to the proxy.
+type sniffingDialer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+type sniffingConn struct {
+	net.Conn
+	sd *sniffingDialer
+}
+
+func (sc sniffingConn) Write(b []byte) (int, error) {
+	sc.sd.mu.Lock()
+	sc.sd.buf.Write(b)
+	sc.sd.mu.Unlock()
+	return sc.Conn.Write(b)
+}
+
+func (sd *sniffingDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if conn, err = socks5.DefaultDialer.DialContext(ctx, network, address); err == nil {
+		conn = sniffingConn{Conn: conn, sd: sd}
+	}
+	return
+}
+
+func (sd *sniffingDialer) String() string {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	return sd.buf.String()
+}
+
+func TestServer_GSSAPI(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	acct := &recordingAccounter{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.GSSAPIAuthenticator{Mechanism: testGSSAPIMechanism{}}},
+		Accounter:      acct,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	sniffer := &sniffingDialer{}
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.ProxyDialer = sniffer
+	cli.Authenticators = []client.Authenticator{client.GSSAPIAuthenticator{Mechanism: testGSSAPIMechanism{initiator: true, principal: "alice@EXAMPLE.COM"}}}
+
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "secret" {
+		t.Error(string(buf), err)
+	}
+	_ = conn.Close()
+
+	rec := acct.final(ctx)
+	if rec.Username != "alice@EXAMPLE.COM" || rec.BytesUp != 6 {
+		t.Errorf("%+v", rec)
+	}
+	if s := sniffer.String(); strings.Contains(s, "secret") || strings.Contains(s, echo.Addr().String()) {
+		t.Errorf("%q", s)
+	}
+}
+
+func TestServer_GSSAPI_Integrity(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen := startServer(t, ctx, &server.Server{
+		Authenticators: []server.Authenticator{server.GSSAPIAuthenticator{Mechanism: testGSSAPIMechanism{}}},
+	})
+	defer listen.Close()
+
+	sniffer := &sniffingDialer{}
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.ProxyDialer = sniffer
+	cli.Authenticators = []client.Authenticator{client.GSSAPIAuthenticator{
+		Mechanism:  testGSSAPIMechanism{initiator: true, principal: "bob"},
+		Protection: socks5.GSSAPIIntegrity,
+	}}
+
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("visible")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "visible" {
+		t.Error(string(buf), err)
+	}
+	if s := sniffer.String(); !strings.Contains(s, "visible") {
+		t.Errorf("%q", s)
+	}
+}
+
+func TestServer_GSSAPI_Rejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{
+		Authenticators: []server.Authenticator{server.GSSAPIAuthenticator{Mechanism: testGSSAPIMechanism{}}},
+	})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Authenticators = []client.Authenticator{client.GSSAPIAuthenticator{Mechanism: testGSSAPIMechanism{initiator: true, principal: "bad"}}}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); !errors.Is(err, socks5.ErrAuthFailed) || !errors.Is(err, socks5.ErrGSSAPIAborted) {
+		t.Error(err)
+	}
+
+	cli.Authenticators = nil
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrNoAcceptableAuthMethods {
+		t.Error(err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"math"
 	"net"
+	"net/netip"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,7 +18,7 @@ const (
 	maxUdpPacket = math.MaxUint16 - 28
 )
 
-func (sess *session) handleASSOCIATE(ctx context.Context) (err error) {
+func (sess *session) handleASSOCIATE(ctx context.Context, clientAddr socks5.Addr) (err error) {
 	var host string
 	if host, _, err = net.SplitHostPort(sess.conn.LocalAddr().String()); err == nil {
 		var clientUDPConn net.PacketConn
@@ -25,16 +27,12 @@ func (sess *session) handleASSOCIATE(ctx context.Context) (err error) {
 			var bindAddr string
 			var bindPort uint16
 			if bindAddr, bindPort, err = socks5.SplitHostPort(clientUDPConn.LocalAddr().String()); err == nil {
-				res := &Response{
-					Reply: socks5.ReplySuccess,
-					Addr:  socks5.AddrFromHostPort(bindAddr, bindPort),
-				}
-				var buf []byte
-				if buf, err = res.MarshalBinary(); err == nil {
-					if _, err = sess.conn.Write(buf); err == nil {
-						_ = sess.Debug && sess.LogDebug("ASSOCIATE", "session", sess.conn.RemoteAddr(), "address", res.Addr)
-						err = sess.serveUDP(ctx, sess.conn, clientUDPConn)
-					}
+				addr := socks5.AddrFromHostPort(bindAddr, bindPort)
+				if err = sess.reply(socks5.ReplySuccess, addr); err == nil {
+					_ = sess.Debug && sess.LogDebug("ASSOCIATE", "session", sess.conn.RemoteAddr(), "address", addr)
+					sess.addGauge(MetricUDPAssociationsActive, 1)
+					err = sess.serveUDP(ctx, sess.conn, clientUDPConn, clientAddr)
+					sess.addGauge(MetricUDPAssociationsActive, -1)
 				}
 			}
 		}
@@ -43,7 +41,7 @@ func (sess *session) handleASSOCIATE(ctx context.Context) (err error) {
 	return sess.fail(err)
 }
 
-func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clientUDPConn net.PacketConn) (err error) {
+func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clientUDPConn net.PacketConn, clientAddr socks5.Addr) (err error) {
 	var tcpClosed atomic.Bool
 	go func() {
 		_, _ = io.Copy(io.Discard, clientTCPConn)
@@ -53,17 +51,28 @@ func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clien
 
 	udpServicers := map[socks5.Addr]*udpService{}
 
+	// wait for the udpServices to stop so all relayed bytes are accounted for
+	var wg sync.WaitGroup
 	defer func() {
 		for _, svc := range udpServicers {
 			_ = svc.target.Close()
 		}
+		wg.Wait()
 	}()
 
+	var nat *udpNAT
+	if sess.UDPNAT != UDPNATSymmetric {
+		nat = newUDPNAT(sess, clientUDPConn)
+		defer nat.close()
+	}
+
+	var reassembly udpReassembly
 	var clientNetAddr net.Addr
 	var clientAddress string
 	var buf [maxUdpPacket]byte
 
 	started := time.Now()
+	sess.touch()
 	err = clientUDPConn.SetReadDeadline(started.Add(UDPTimeout / 10))
 
 	for err == nil {
@@ -71,40 +80,66 @@ func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clien
 		var addr net.Addr
 		if n, addr, err = clientUDPConn.ReadFrom(buf[:]); err == nil {
 			gotAddr := addr.String()
-			if clientNetAddr == nil {
+			if clientNetAddr == nil && sess.allowUDPSource(clientAddr, addr) {
 				clientNetAddr = addr
 				clientAddress = gotAddr
 			}
 			if clientAddress == gotAddr {
 				var pkt *socks5.UDPPacket
-				if pkt, err = socks5.ParseUDPPacket(buf[:n]); err == nil {
-					var svc *udpService
-					if svc = udpServicers[pkt.Addr]; svc == nil {
-						var targetConn net.Conn
-						if targetConn, err = sess.DialContext(ctx, "udp", pkt.Addr.String()); err == nil {
-							svc = &udpService{
-								srv:        sess.Server,
-								started:    started,
-								client:     clientUDPConn,
-								clientaddr: clientNetAddr,
-								target:     targetConn,
-								targetaddr: pkt.Addr,
+				if pkt, err = socks5.ParseUDPFragment(buf[:n]); err == nil {
+					if pkt = reassembly.add(pkt, time.Now()); pkt != nil {
+						symmetric := nat == nil
+						if !symmetric {
+							if err = nat.send(ctx, clientNetAddr, pkt); err == errUDPNATUnsupported {
+								symmetric, err = true, nil
 							}
-							udpServicers[pkt.Addr] = svc
-							go svc.serve()
 						}
-					}
-					if svc != nil {
-						var nn int
-						if nn, err = svc.target.Write(pkt.Body); err == nil {
-							if err = socks5.MustEqual(nn, len(pkt.Body), io.ErrShortWrite); err == nil {
-								svc.when.Store(int64(time.Since(started)))
+						if symmetric {
+							var svc *udpService
+							if svc = udpServicers[pkt.Addr]; svc == nil {
+								var targetConn net.Conn
+								if addrs, ok := sess.allowUDPTarget(ctx, len(udpServicers), pkt.Addr.String()); !ok {
+									err = errUDPTargetDenied
+								} else if targetConn, err = sess.dialChecked(ctx, "udp", pkt.Addr.String(), addrs); err == nil {
+									svc = &udpService{
+										sess:       sess,
+										started:    started,
+										client:     clientUDPConn,
+										clientaddr: clientNetAddr,
+										target:     targetConn,
+										targetaddr: pkt.Addr,
+									}
+									udpServicers[pkt.Addr] = svc
+									wg.Add(1)
+									go func() {
+										defer wg.Done()
+										svc.serve()
+									}()
+								}
+								if err == errUDPTargetDenied {
+									err = nil
+								}
+							}
+							if svc != nil && sess.allowPacket(len(pkt.Body), true) {
+								var nn int
+								if nn, err = svc.target.Write(pkt.Body); err == nil {
+									if err = socks5.MustEqual(nn, len(pkt.Body), io.ErrShortWrite); err == nil {
+										svc.when.Store(int64(time.Since(started)))
+										sess.touch()
+										sess.addBytes(nn, true)
+									}
+								}
 							}
 						}
 					}
 				}
 			}
 		} else if isTimeout(err) {
+			reassembly.expire(time.Now())
+			sess.expireUDPDenied(time.Now())
+			if nat != nil {
+				nat.expire()
+			}
 			timeout := int64((time.Since(started) - UDPTimeout))
 			for _, svc := range udpServicers {
 				if when := svc.when.Load(); when < timeout {
@@ -112,6 +147,11 @@ func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clien
 					delete(udpServicers, svc.targetaddr)
 				}
 			}
+			if sess.IdleTimeout > 0 && sess.idle() >= sess.IdleTimeout {
+				_ = sess.Debug && sess.LogDebug("ASSOCIATE idle", "session", sess.conn.RemoteAddr())
+				err = nil
+				break
+			}
 			err = clientUDPConn.SetReadDeadline(time.Now().Add(UDPTimeout / 10))
 		}
 	}
@@ -123,13 +163,73 @@ func (sess *session) serveUDP(ctx context.Context, clientTCPConn net.Conn, clien
 	return
 }
 
+// allowUDPSource returns true if an ASSOCIATE datagram from src may be from the client,
+// which declared it would send from clientAddr.
+func (sess *session) allowUDPSource(clientAddr socks5.Addr, src net.Addr) (ok bool) {
+	if ok = sess.AllowUDPSourceMismatch; !ok {
+		var srcip netip.Addr
+		if ua, isUDP := src.(*net.UDPAddr); isUDP {
+			srcip = ua.AddrPort().Addr().Unmap()
+			ok = clientAddr.Port == 0 || clientAddr.Port == ua.AddrPort().Port()
+		}
+		if ip, err := netip.ParseAddr(clientAddr.Addr); ok && err == nil && !ip.IsUnspecified() {
+			ok = ip.Unmap() == srcip
+		}
+		if tcpaddr, err := netip.ParseAddrPort(sess.rawconn.RemoteAddr().String()); ok && err == nil {
+			ok = tcpaddr.Addr().Unmap() == srcip
+		}
+		if !ok {
+			_ = sess.Debug && sess.LogDebug("ASSOCIATE source refused", "session", sess.conn.RemoteAddr(), "source", src, "declared", clientAddr)
+		}
+	}
+	return
+}
+
+// errUDPTargetDenied is used internally by serveUDP for targets that are not allowed.
+var errUDPTargetDenied = errors.New("ASSOCIATE target denied")
+
+// allowUDPTarget returns true if a new ASSOCIATE target may be added to the n existing ones,
+// and the addresses the RequestFilter resolved it to if any. Targets denied by the RequestFilter
+// are remembered for UDPTimeout, so their datagrams are dropped without checking them again.
+func (sess *session) allowUDPTarget(ctx context.Context, n int, addr string) (addrs []string, ok bool) {
+	if _, denied := sess.udpDenied[addr]; !denied {
+		if ok = sess.MaxUDPTargets < 1 || n < sess.MaxUDPTargets; !ok {
+			_ = sess.Debug && sess.LogDebug("ASSOCIATE target limit reached", "session", sess.conn.RemoteAddr(), "address", addr)
+		} else {
+			var err error
+			if addrs, err = sess.filter(ctx, socks5.CommandAssociate, addr); err != nil {
+				ok = false
+				sess.denyUDPTarget(addr)
+			}
+		}
+	}
+	return
+}
+
+// denyUDPTarget drops datagrams for the ASSOCIATE target addr for UDPTimeout.
+func (sess *session) denyUDPTarget(addr string) {
+	if sess.udpDenied == nil {
+		sess.udpDenied = make(map[string]time.Time)
+	}
+	sess.udpDenied[addr] = time.Now()
+}
+
+// expireUDPDenied forgets ASSOCIATE targets denied more than UDPTimeout ago.
+func (sess *session) expireUDPDenied(now time.Time) {
+	for addr, when := range sess.udpDenied {
+		if now.Sub(when) > UDPTimeout {
+			delete(sess.udpDenied, addr)
+		}
+	}
+}
+
 func isTimeout(err error) bool {
-	terr, ok := errors.Unwrap(err).(interface{ Timeout() bool })
-	return ok && terr.Timeout()
+	var terr interface{ Timeout() bool }
+	return errors.As(err, &terr) && terr.Timeout()
 }
 
 type udpService struct {
-	srv        *Server
+	sess       *session
 	started    time.Time
 	client     net.PacketConn
 	clientaddr net.Addr
@@ -150,13 +250,15 @@ func (svc *udpService) serve() {
 			var srcnetaddr net.Addr
 			if n, srcnetaddr, err = pktconn.ReadFrom(buf[:]); err == nil {
 				var srcaddr socks5.Addr
-				if srcaddr, err = socks5.AddrFromString(srcnetaddr.String()); err == nil {
+				if srcaddr, err = socks5.AddrFromString(srcnetaddr.String()); err == nil && svc.sess.allowPacket(n, false) {
 					var b []byte
 					if b, err = (&socks5.UDPPacket{Addr: srcaddr, Body: buf[:n]}).MarshalBinary(); err == nil {
 						var nn int
 						if nn, err = svc.client.WriteTo(b, svc.clientaddr); err == nil {
 							if err = socks5.MustEqual(nn, len(b), io.ErrShortWrite); err == nil {
 								svc.when.Store(int64(time.Since(svc.started)))
+								svc.sess.touch()
+								svc.sess.addBytes(n, false)
 							}
 						}
 					}
@@ -164,5 +266,5 @@ func (svc *udpService) serve() {
 			}
 		}
 	}
-	svc.srv.LogError("udpService.serve()", "error", err, "client", svc.client.LocalAddr().String(), "target", svc.target.RemoteAddr().String(), "targetaddr", svc.targetaddr.String())
+	svc.sess.LogError("udpService.serve()", "error", err, "client", svc.client.LocalAddr().String(), "target", svc.target.RemoteAddr().String(), "targetaddr", svc.targetaddr.String())
 }
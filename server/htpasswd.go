@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/linkdata/socks5"
+)
+
+var ErrInvalidHtpasswdLine = errors.New("invalid htpasswd line")
+
+const (
+	// PBKDF2Prefix starts password hashes made by HashPassword.
+	PBKDF2Prefix = "$pbkdf2-sha256$"
+	// DefaultPBKDF2Iterations is the iteration count HashPassword uses if none is given.
+	DefaultPBKDF2Iterations = 600000
+	pbkdf2SaltSize          = 16
+)
+
+// PasswordVerifier returns true if password matches hash.
+// Implementations should compare in constant time.
+type PasswordVerifier func(hash, password string) bool
+
+// HashPassword returns a salted PBKDF2-SHA256 hash of password in the form
+// "$pbkdf2-sha256$<iterations>$<salt>$<key>", with salt and key in unpadded base64.
+// If iterations is zero or less, DefaultPBKDF2Iterations is used.
+func HashPassword(password string, iterations int) (hash string, err error) {
+	if iterations <= 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+	salt := make([]byte, pbkdf2SaltSize)
+	if _, err = rand.Read(salt); err == nil {
+		var key []byte
+		if key, err = pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size); err == nil {
+			hash = PBKDF2Prefix + strconv.Itoa(iterations) + "$" +
+				base64.RawStdEncoding.EncodeToString(salt) + "$" +
+				base64.RawStdEncoding.EncodeToString(key)
+		}
+	}
+	return
+}
+
+// VerifyPBKDF2 is a PasswordVerifier for hashes made by HashPassword.
+func VerifyPBKDF2(hash, password string) bool {
+	if fields := strings.Split(strings.TrimPrefix(hash, PBKDF2Prefix), "$"); len(fields) == 3 && strings.HasPrefix(hash, PBKDF2Prefix) {
+		if iterations, err := strconv.Atoi(fields[0]); err == nil && iterations > 0 {
+			if salt, err := base64.RawStdEncoding.DecodeString(fields[1]); err == nil {
+				if want, err := base64.RawStdEncoding.DecodeString(fields[2]); err == nil && len(want) > 0 {
+					if got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want)); err == nil {
+						return subtle.ConstantTimeCompare(got, want) == 1
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ReadHtpasswd reads "username:hash" lines. Empty lines and lines starting with '#' are ignored.
+func ReadHtpasswd(r io.Reader) (users map[string]string, err error) {
+	users = make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for err == nil && scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			username, hash, ok := strings.Cut(line, ":")
+			if err = socks5.MustEqual(ok && username != "" && hash != "", true, ErrInvalidHtpasswdLine); err == nil {
+				users[username] = hash
+			}
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		users = nil
+		err = socks5.Note(err, "line "+strconv.Itoa(lineno))
+	}
+	return
+}
+
+// WriteHtpasswd writes "username:hash" lines sorted by username.
+func WriteHtpasswd(w io.Writer, users map[string]string) (err error) {
+	var names []string
+	for username := range users {
+		names = append(names, username)
+	}
+	slices.Sort(names)
+	for _, username := range names {
+		if err == nil {
+			_, err = io.WriteString(w, username+":"+users[username]+"\n")
+		}
+	}
+	return
+}
+
+// HtpasswdFile is a CredentialsValidator using salted password hashes read from a file
+// in htpasswd format, see ReadHtpasswd.
+//
+// Hashes starting with PBKDF2Prefix are supported by default. Other formats, like bcrypt,
+// can be supported by adding a PasswordVerifier for their prefix to Verifiers.
+//
+// Validating credentials rereads the file if it changed, so users can be added or have
+// their password changed without restarting the server. An edit that can't be read leaves
+// the previously loaded users in place; until the file has been read once, no one can log in.
+type HtpasswdFile struct {
+	Path      string                      // path to htpasswd file
+	Verifiers map[string]PasswordVerifier // additional verifiers by hash prefix, e.g. "$2y$" for bcrypt
+	mu        sync.Mutex
+	watcher   fileWatcher
+	users     map[string]string
+	err       error // last load error
+}
+
+var _ CredentialsValidator = &HtpasswdFile{}
+
+// NewHtpasswdFile returns a HtpasswdFile with the users loaded from the file at path.
+func NewHtpasswdFile(path string) (hf *HtpasswdFile, err error) {
+	hf = &HtpasswdFile{Path: path}
+	if err = hf.Reload(); err != nil {
+		hf = nil
+	}
+	return
+}
+
+func (hf *HtpasswdFile) loadLocked(force bool) {
+	var changed bool
+	if changed, hf.err = hf.watcher.changed(hf.Path, force || hf.users == nil); changed {
+		var f *os.File
+		if f, hf.err = os.Open(hf.Path); hf.err == nil {
+			defer f.Close()
+			var users map[string]string
+			if users, hf.err = ReadHtpasswd(f); hf.err == nil {
+				hf.users = users
+			}
+		}
+	}
+}
+
+// Reload reads the file even if it has not changed, and returns any error encountered.
+func (hf *HtpasswdFile) Reload() (err error) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	hf.loadLocked(true)
+	return hf.err
+}
+
+func (hf *HtpasswdFile) lookup(username string) (hash string, ok bool) {
+	hf.mu.Lock()
+	defer hf.mu.Unlock()
+	hf.loadLocked(false)
+	hash, ok = hf.users[username]
+	return
+}
+
+func (hf *HtpasswdFile) verifier(hash string) PasswordVerifier {
+	for prefix, v := range hf.Verifiers {
+		if strings.HasPrefix(hash, prefix) {
+			return v
+		}
+	}
+	if strings.HasPrefix(hash, PBKDF2Prefix) {
+		return VerifyPBKDF2
+	}
+	return nil
+}
+
+// dummyHash is verified against for unknown users, so that they take as long to reject as known ones.
+var dummyHash = sync.OnceValue(func() (hash string) {
+	hash, _ = HashPassword("", 0)
+	return
+})
+
+func (hf *HtpasswdFile) ValidateCredentials(username, password, _ string) bool {
+	hash, ok := hf.lookup(username)
+	if !ok {
+		hash = dummyHash()
+	}
+	if v := hf.verifier(hash); v != nil {
+		return v(hash, password) && ok
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5/server"
+)
+
+func TestHashPassword(t *testing.T) {
+	hash, err := server.HashPassword("secret", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, server.PBKDF2Prefix+"1000$") {
+		t.Error(hash)
+	}
+	if !server.VerifyPBKDF2(hash, "secret") {
+		t.Error("password not verified")
+	}
+	if server.VerifyPBKDF2(hash, "Secret") {
+		t.Error("wrong password verified")
+	}
+	if other, _ := server.HashPassword("secret", 1000); other == hash {
+		t.Error("hash not salted")
+	}
+	for _, s := range []string{"", "secret", server.PBKDF2Prefix, server.PBKDF2Prefix + "0$AAAA$AAAA", strings.Replace(hash, "$1000$", "$x$", 1)} {
+		if server.VerifyPBKDF2(s, "secret") {
+			t.Errorf("%q verified", s)
+		}
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	users, err := server.ReadHtpasswd(strings.NewReader("# comment\n\njoe:hash1\nann:hash:2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users["joe"] != "hash1" || users["ann"] != "hash:2" {
+		t.Error(users)
+	}
+	var buf bytes.Buffer
+	if err = server.WriteHtpasswd(&buf, users); err != nil {
+		t.Fatal(err)
+	}
+	if s := buf.String(); s != "ann:hash:2\njoe:hash1\n" {
+		t.Errorf("%q", s)
+	}
+	if _, err = server.ReadHtpasswd(strings.NewReader("joe:hash1\nann\n")); !errors.Is(err, server.ErrInvalidHtpasswdLine) || !strings.Contains(err.Error(), "line 2") {
+		t.Error(err)
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	defer func(old time.Duration) { server.FileCheckInterval = old }(server.FileCheckInterval)
+	server.FileCheckInterval = 0
+
+	fn := filepath.Join(t.TempDir(), "htpasswd")
+	if _, err := server.NewHtpasswdFile(fn); err == nil {
+		t.Error("expected error")
+	}
+	hash, err := server.HashPassword("secret", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(fn, []byte("joe:"+hash+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hf, err := server.NewHtpasswdFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hf.ValidateCredentials("joe", "secret", "") {
+		t.Error("joe not valid")
+	}
+	if hf.ValidateCredentials("joe", "wrong", "") || hf.ValidateCredentials("ann", "secret", "") {
+		t.Error("invalid credentials accepted")
+	}
+
+	// file changes are picked up, and other hash formats can be added
+	if err = os.WriteFile(fn, []byte("joe:"+hash+"\nann:$plain$pw\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if hf.ValidateCredentials("ann", "pw", "") {
+		t.Error("unsupported hash accepted")
+	}
+	hf.Verifiers = map[string]server.PasswordVerifier{
+		"$plain$": func(hash, password string) bool { return hash == "$plain$"+password },
+	}
+	if !hf.ValidateCredentials("ann", "pw", "") {
+		t.Error("ann not valid")
+	}
+
+	// invalid file keeps the previous users
+	if err = os.WriteFile(fn, []byte("garbage\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = hf.Reload(); err == nil {
+		t.Error("expected error")
+	}
+	if !hf.ValidateCredentials("joe", "secret", "") {
+		t.Error("joe not valid")
+	}
+}
+
+func TestStaticCredentials(t *testing.T) {
+	creds := server.StaticCredentials{"joe": "secret", "ann": ""}
+	if !creds.ValidateCredentials("joe", "secret", "") || !creds.ValidateCredentials("ann", "", "") {
+		t.Error("valid credentials rejected")
+	}
+	if creds.ValidateCredentials("joe", "secre", "") || creds.ValidateCredentials("bob", "", "") {
+		t.Error("invalid credentials accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/linkdata/socks5"
+)
+
+// hopHeaders are the hop-by-hop headers removed from forwarded requests.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// readerConn is a net.Conn that reads from r.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpStatus returns the HTTP status code for a reply code.
+func httpStatus(code socks5.ReplyCode) (status int) {
+	switch code {
+	case socks5.ReplySuccess:
+		status = http.StatusOK
+	case socks5.ReplyConnectionNotAllowed:
+		status = http.StatusForbidden
+	case socks5.ReplyTTLExpired:
+		status = http.StatusGatewayTimeout
+	case socks5.ReplyCommandNotSupported, socks5.ReplyAddrTypeNotSupported:
+		status = http.StatusBadRequest
+	default:
+		status = http.StatusBadGateway
+	}
+	return
+}
+
+// httpReply returns the HTTP response for a reply code. Successfully forwarded
+// requests get their response from the target, so nothing is returned for those.
+func httpReply(code socks5.ReplyCode, forward bool) (pkt []byte) {
+	if status := httpStatus(code); status != http.StatusOK {
+		pkt = fmt.Appendf(pkt, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+	} else if !forward {
+		pkt = append(pkt, "HTTP/1.1 200 Connection established\r\n\r\n"...)
+	}
+	return
+}
+
+// httpTarget returns the address the request is for.
+func httpTarget(req *http.Request) (addr socks5.Addr, err error) {
+	err = socks5.ErrReplyAddrTypeNotSupported
+	hostport := req.URL.Host
+	if req.Method != http.MethodConnect {
+		hostport = ""
+		if req.URL.Scheme == "http" && req.URL.Host != "" {
+			hostport = req.URL.Host
+			if req.URL.Port() == "" {
+				hostport = net.JoinHostPort(req.URL.Hostname(), "80")
+			}
+		}
+	}
+	if hostport != "" {
+		if addr, err = socks5.AddrFromString(hostport); err != nil {
+			err = socks5.ErrReplyAddrTypeNotSupported
+		}
+	}
+	return
+}
+
+// httpRequestHead returns the request line and headers to send to the target for a forwarded request.
+// The target is asked to close the connection after responding.
+func httpRequestHead(req *http.Request) []byte {
+	hdr := req.Header.Clone()
+	for _, v := range hdr.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			hdr.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		hdr.Del(name)
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	_ = hdr.Write(&b)
+	if slices.Contains(req.TransferEncoding, "chunked") {
+		b.WriteString("Transfer-Encoding: chunked\r\n")
+	}
+	b.WriteString("Connection: close\r\n\r\n")
+	return b.Bytes()
+}
+
+// httpRequestBody returns the body to send to the target for a forwarded request,
+// chunk encoded if the client sent it that way.
+func httpRequestBody(req *http.Request) io.Reader {
+	if slices.Contains(req.TransferEncoding, "chunked") {
+		return &chunkEncoder{r: req.Body}
+	}
+	return req.Body
+}
+
+// chunkEncoder reads r using chunked transfer encoding, without trailers.
+type chunkEncoder struct {
+	r   io.Reader
+	buf []byte // encoded data not yet read
+	err error  // error from r
+}
+
+func (ce *chunkEncoder) Read(b []byte) (n int, err error) {
+	for len(ce.buf) == 0 && ce.err == nil {
+		chunk := make([]byte, max(len(b), 512))
+		var nn int
+		if nn, ce.err = ce.r.Read(chunk); nn > 0 {
+			ce.buf = fmt.Appendf(ce.buf, "%x\r\n%s\r\n", nn, chunk[:nn])
+		}
+		if ce.err == io.EOF {
+			ce.buf = append(ce.buf, "0\r\n\r\n"...)
+		}
+	}
+	n = copy(b, ce.buf)
+	ce.buf = ce.buf[n:]
+	if len(ce.buf) == 0 {
+		err = ce.err
+	}
+	return
+}
+
+// drainReader discards everything read from r, returning only the error that ends it.
+type drainReader struct {
+	r io.Reader
+}
+
+func (dr drainReader) Read(b []byte) (n int, err error) {
+	for err == nil {
+		_, err = dr.r.Read(b)
+	}
+	return
+}
+
+// proxyBasicAuth returns the username and password from the Proxy-Authorization header.
+func proxyBasicAuth(req *http.Request) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if auth := req.Header.Get("Proxy-Authorization"); len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		if b, err := base64.StdEncoding.DecodeString(auth[len(prefix):]); err == nil {
+			username, password, ok = strings.Cut(string(b), ":")
+		}
+	}
+	return
+}
+
+// authenticateHTTP authenticates an HTTP proxy client using the Authenticators. Basic authentication
+// credentials are checked as socks5.AuthUserPass, and socks5.AuthMethodNone is always offered.
+func (sess *session) authenticateHTTP(ctx context.Context, req *http.Request) (id *Identity, err error) {
+	methods := []socks5.AuthMethod{socks5.AuthMethodNone}
+	var payload []byte
+	if username, password, ok := proxyBasicAuth(req); ok {
+		methods = append([]socks5.AuthMethod{socks5.AuthUserPass}, methods...)
+		payload = append(payload, socks5.AuthUserPassVersion)
+		if payload, err = socks5.AppendString(payload, username, socks5.ErrIllegalUsername); err == nil {
+			payload, err = socks5.AppendString(payload, password, socks5.ErrIllegalPassword)
+		}
+	}
+	if err == nil {
+		id, err = sess.authenticateMethods(ctx, &offlineConn{Conn: sess.conn, r: bytes.NewReader(payload)}, methods)
+	}
+	return
+}
+
+// serveHTTP handles an HTTP proxy session. The first byte of the request must already have been read.
+func (sess *session) serveHTTP(ctx context.Context, first byte) (err error) {
+	sess.proto = protoHTTPConnect
+	conn := sess.conn
+	lr := &io.LimitedReader{R: io.MultiReader(bytes.NewReader([]byte{first}), conn), N: int64(HTTPMaxHeaderBytes)}
+	br := bufio.NewReader(lr)
+	sess.conn = &readerConn{Conn: conn, r: br}
+	var req *http.Request
+	if req, err = http.ReadRequest(br); err == nil {
+		lr.N = math.MaxInt64
+		if req.Method != http.MethodConnect {
+			sess.proto = protoHTTPForward
+		}
+		var addr socks5.Addr
+		if addr, err = httpTarget(req); err == nil {
+			_ = sess.Debug && sess.LogDebug("HTTP", "session", conn.RemoteAddr(), "method", req.Method, "target", addr)
+			if sess.identity, err = sess.authenticateHTTP(ctx, req); err == nil {
+				sess.username = sess.identity.Username
+				if sess.proto == protoHTTPForward {
+					// only this request is relayed, anything the client sends after it is discarded
+					sess.conn = &readerConn{Conn: conn, r: io.MultiReader(bytes.NewReader(httpRequestHead(req)), httpRequestBody(req), drainReader{r: br})}
+				}
+				err = sess.serveRequest(ctx, &Request{Addr: addr, Cmd: socks5.CommandConnect})
+			} else {
+				sess.replied = true
+				_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+					"Proxy-Authenticate: Basic realm=\"proxy\"\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+			}
+		}
+	} else if lr.N <= 0 {
+		sess.replied = true
+		_, _ = io.WriteString(conn, "HTTP/1.1 431 Request Header Fields Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+	}
+	return sess.fail(err)
+}
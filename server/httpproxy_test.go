@@ -0,0 +1,314 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func httpConnect(t *testing.T, proxy, target, auth string) (conn net.Conn, resp *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err = io.WriteString(conn, req+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestServer_HTTP_Connect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	acct := &recordingAccounter{}
+	srv := &server.Server{
+		AllowHTTP:      true,
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+		Accounter:      acct,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	conn, resp := httpConnect(t, listen.Addr().String(), echo.Addr().String(), "")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Error(resp.Status, resp.Header)
+	}
+
+	conn, resp = httpConnect(t, listen.Addr().String(), echo.Addr().String(), "Basic dTp4")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Error(resp.Status)
+	}
+
+	conn, resp = httpConnect(t, listen.Addr().String(), echo.Addr().String(), "Basic dTpw")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Error(string(buf), err)
+	}
+	_ = conn.Close()
+
+	rec := acct.final(ctx)
+	if rec.Username != "u" || rec.Command != socks5.CommandConnect || rec.Target != echo.Addr().String() || rec.BytesUp != 5 {
+		t.Errorf("%+v", rec)
+	}
+}
+
+func TestServer_HTTP_Forward(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %q %q", r.Method, r.URL.Path, body, r.Header.Get("Proxy-Authorization"))
+	}))
+	defer origin.Close()
+
+	listen := startServer(t, ctx, &server.Server{
+		AllowHTTP:      true,
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+	})
+	defer listen.Close()
+
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("u", "p"), Host: listen.Addr().String()})}}
+	defer hc.CloseIdleConnections()
+
+	resp, err := hc.Get(origin.URL + "/get")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if s := string(body); s != `GET /get "" ""` {
+		t.Error(s)
+	}
+
+	// unknown length, sent chunked
+	resp, err = hc.Post(origin.URL+"/post", "text/plain", io.MultiReader(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if s := string(body); s != `POST /post "hello" ""` {
+		t.Error(s)
+	}
+
+	resp, err = http.Get("http://" + listen.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HTTP_ForwardOnlyFirstRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// the target answers one request, and reports anything it receives after it
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	extra := make(chan string, 1)
+	go func() {
+		if conn, err := target.Accept(); err == nil {
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+			if _, err = http.ReadRequest(br); err == nil {
+				_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+				b, _ := io.ReadAll(br)
+				extra <- string(b)
+			}
+		}
+	}()
+
+	listen := startServer(t, ctx, &server.Server{AllowHTTP: true})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reqs := "GET http://" + target.Addr().String() + "/first HTTP/1.1\r\nHost: " + target.Addr().String() + "\r\n\r\n" +
+		"GET http://other.test/second HTTP/1.1\r\nHost: other.test\r\nProxy-Authorization: Basic dTpw\r\n\r\n"
+	if _, err = io.WriteString(conn, reqs); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if s := <-extra; s != "" {
+		t.Errorf("%q", s)
+	}
+	if _, err = http.ReadResponse(br, nil); err == nil {
+		t.Error("second request answered")
+	}
+}
+
+func TestServer_HTTP_Denied(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{AllowHTTP: true, RequestFilter: denyFilter{}})
+	defer listen.Close()
+
+	conn, resp := httpConnect(t, listen.Addr().String(), "127.0.0.1:1", "")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HTTP_AutoDetect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen := startServer(t, ctx, &server.Server{AllowHTTP: true, AllowSOCKS4: true})
+	defer listen.Close()
+
+	for _, scheme := range []string{"socks5h", "socks4a"} {
+		cli, err := client.New(scheme + "://" + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(scheme, err)
+		}
+		_ = conn.Close()
+	}
+	conn, resp := httpConnect(t, listen.Addr().String(), echo.Addr().String(), "")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HTTP_Authenticators(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	tc := &server.ThrottledCredentials{Credentials: server.StaticCredentials{"u": "p"}}
+	srv := &server.Server{
+		AllowHTTP:      true,
+		Authenticators: []server.Authenticator{&server.UserPassAuthenticator{Credentials: tc}},
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	conn, resp := httpConnect(t, listen.Addr().String(), echo.Addr().String(), "Basic dTpw")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.Status)
+	}
+	conn, resp = httpConnect(t, listen.Addr().String(), echo.Addr().String(), "Basic "+strings.Repeat("x", 400))
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HTTP_HeaderTooLarge(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{AllowHTTP: true})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		_, _ = io.WriteString(conn, "CONNECT 127.0.0.1:1 HTTP/1.1\r\nX-Large: "+strings.Repeat("x", server.HTTPMaxHeaderBytes)+"\r\n\r\n")
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Error(resp.Status)
+	}
+}
+
+func TestServer_HTTP_NoReplyAfterConnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// the target resets the connection, failing the relay
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			_ = c.(*net.TCPConn).SetLinger(0)
+			_ = c.Close()
+		}
+	}()
+
+	listen := startServer(t, ctx, &server.Server{AllowHTTP: true})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, "CONNECT "+target.Addr().String()+" HTTP/1.1\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	b, _ := io.ReadAll(conn)
+	if s := string(b); s != "HTTP/1.1 200 Connection established\r\n\r\n" {
+		t.Errorf("%q", s)
+	}
+}
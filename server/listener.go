@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -10,8 +12,65 @@ type listener struct {
 	srv *Server
 	key string
 	net.Listener
-	refs atomic.Int32
-	died atomic.Int64
+	refs     atomic.Int32
+	died     atomic.Int64
+	conns    chan net.Conn // connections accepted by acceptLoop
+	done     chan struct{} // closed when acceptLoop returns
+	err      error         // error that ended acceptLoop, set before done is closed
+	closing  chan struct{} // closed by stop
+	stopOnce sync.Once
+}
+
+func newListener(srv *Server, key string, nl net.Listener) (l *listener) {
+	l = &listener{
+		srv:      srv,
+		key:      key,
+		Listener: nl,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return
+}
+
+// acceptLoop accepts connections and hands each one to the next BIND session waiting
+// for one. Since only sessions still waiting receive them, a session that gives up
+// can't take a connection meant for another session sharing the listener.
+func (l *listener) acceptLoop() {
+	defer close(l.done)
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.closing:
+			_ = conn.Close()
+		}
+	}
+}
+
+// acceptContext waits for the next connection on the listener or until ctx is done.
+func (l *listener) acceptContext(ctx context.Context) (conn net.Conn, err error) {
+	select {
+	case conn = <-l.conns:
+	case <-l.done:
+		err = l.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+// stop closes the underlying listener.
+func (l *listener) stop() {
+	l.stopOnce.Do(func() {
+		close(l.closing)
+		_ = l.Listener.Close()
+	})
 }
 
 func (l *listener) Close() (err error) {
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// Metrics receives measurements from the Server. Labels are given as name, value pairs.
+//
+// See PrometheusMetrics for an implementation.
+type Metrics interface {
+	// AddCounter adds delta to a monotonically increasing counter.
+	AddCounter(name string, delta float64, labels ...string)
+	// AddGauge adds delta, which may be negative, to a gauge.
+	AddGauge(name string, delta float64, labels ...string)
+	// Observe records a value in a histogram.
+	Observe(name string, value float64, labels ...string)
+}
+
+// Names of the metrics reported by the Server.
+const (
+	MetricConnectionsAccepted   = "socks5_connections_accepted_total" // counter
+	MetricAuth                  = "socks5_auth_total"                 // counter, labels "method" and "result"
+	MetricAuthLockouts          = "socks5_auth_lockouts_total"        // counter, label "kind" ("user" or "source"), from ThrottledCredentials
+	MetricCommands              = "socks5_commands_total"             // counter, label "command"
+	MetricReplies               = "socks5_replies_total"              // counter, label "code"
+	MetricBytesRelayed          = "socks5_bytes_relayed_total"        // counter, label "direction" ("up" or "down")
+	MetricSessionsActive        = "socks5_sessions_active"            // gauge
+	MetricBindListenersActive   = "socks5_bind_listeners_active"      // gauge
+	MetricUDPAssociationsActive = "socks5_udp_associations_active"    // gauge
+	MetricDialDuration          = "socks5_dial_duration_seconds"      // histogram, labels "network" and "result"
+)
+
+func (s *Server) addCounter(name string, delta float64, labels ...string) {
+	if s.Metrics != nil {
+		s.Metrics.AddCounter(name, delta, labels...)
+	}
+}
+
+func (s *Server) addGauge(name string, delta float64, labels ...string) {
+	if s.Metrics != nil {
+		s.Metrics.AddGauge(name, delta, labels...)
+	}
+}
+
+func (s *Server) observe(name string, value float64, labels ...string) {
+	if s.Metrics != nil {
+		s.Metrics.Observe(name, value, labels...)
+	}
+}
+
+func resultLabel(err error) string {
+	if err == nil {
+		return "success"
+	}
+	return "failure"
+}
+
+func (s *Server) countAuth(am socks5.AuthMethod, err error) {
+	s.addCounter(MetricAuth, 1, "method", am.String(), "result", resultLabel(err))
+}
+
+func (s *Server) countReply(code socks5.ReplyCode) {
+	s.addCounter(MetricReplies, 1, "code", strconv.Itoa(int(code)))
+}
+
+func (s *Server) observeDial(network string, started time.Time, err error) {
+	s.observe(MetricDialDuration, time.Since(started).Seconds(), "network", network, "result", resultLabel(err))
+}
+
+// addBytes counts n bytes relayed, either from the client if up is true, or to the client otherwise.
+func (sess *session) addBytes(n int, up bool) {
+	if n > 0 {
+		direction := "down"
+		if up {
+			direction = "up"
+			sess.bytesUp.Add(int64(n))
+		} else {
+			sess.bytesDown.Add(int64(n))
+		}
+		sess.addCounter(MetricBytesRelayed, float64(n), "direction", direction)
+	}
+}
@@ -0,0 +1,109 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	pm := &server.PrometheusMetrics{Buckets: []float64{1, 2}}
+	pm.AddCounter("c_total", 2, "a", "x\"y")
+	pm.AddCounter("c_total", 1, "a", "x\"y")
+	pm.AddCounter("c_total", -1, "a", "x\"y")
+	pm.AddGauge("g", 3)
+	pm.AddGauge("g", -1)
+	pm.AddCounter("g", 1)
+	pm.Observe("h", 0.5, "n", "tcp")
+	pm.Observe("h", 1.5, "n", "tcp")
+	pm.Observe("h", 5, "n", "tcp")
+
+	rec := httptest.NewRecorder()
+	pm.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Error(ct)
+	}
+	want := `# TYPE c_total counter
+c_total{a="x\"y"} 3
+# TYPE g gauge
+g 2
+# TYPE h histogram
+h_bucket{n="tcp",le="1"} 1
+h_bucket{n="tcp",le="2"} 2
+h_bucket{n="tcp",le="+Inf"} 3
+h_sum{n="tcp"} 7
+h_count{n="tcp"} 3
+`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	pm := &server.PrometheusMetrics{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}},
+		Metrics:        pm,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if s := pm.String(); !strings.Contains(s, "socks5_sessions_active 1\n") {
+		t.Error(s)
+	}
+	_ = conn.Close()
+
+	bad, err := client.New("socks5h://u:x@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bad.DialContext(ctx, "tcp", echo.Addr().String()); err == nil {
+		t.Error("expected error")
+	}
+
+	for srv.Sessions() > 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	s := pm.String()
+	for _, want := range []string{
+		"socks5_connections_accepted_total 2\n",
+		`socks5_auth_total{method="userpass",result="success"} 1` + "\n",
+		`socks5_auth_total{method="userpass",result="failure"} 1` + "\n",
+		`socks5_commands_total{command="CONNECT"} 1` + "\n",
+		`socks5_replies_total{code="0"} 1` + "\n",
+		`socks5_bytes_relayed_total{direction="up"} 5` + "\n",
+		`socks5_bytes_relayed_total{direction="down"} 5` + "\n",
+		`socks5_dial_duration_seconds_count{network="tcp",result="success"} 1` + "\n",
+		"socks5_sessions_active 0\n",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("missing %q in\n%s", want, s)
+		}
+	}
+}
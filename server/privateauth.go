@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// SecretLookuper provides the shared secrets used by HMACAuthenticator.
+type SecretLookuper interface {
+	// LookupSecret returns the shared secret for username, or false if there is none.
+	LookupSecret(username, address string) (secret []byte, ok bool)
+}
+
+// isPrivateAuthMethod returns true if am is in the range reserved for private methods (RFC 1928, section 3).
+func isPrivateAuthMethod(am socks5.AuthMethod) bool {
+	return am >= 0x80 && am < socks5.AuthNoAcceptable
+}
+
+// HMACAuthenticator is used to handle the private socks5.AuthHMAC challenge-response
+// method, which unlike UserPassAuthenticator never sends the password.
+type HMACAuthenticator struct {
+	Secrets SecretLookuper // if nil, all attempts fail
+}
+
+var _ ContextAuthenticator = HMACAuthenticator{}
+
+func (a HMACAuthenticator) Socks5AuthenticateContext(_ context.Context, info *ConnInfo, am socks5.AuthMethod) (*Identity, error) {
+	return usernameIdentity(a.Socks5Authenticate(info.Conn, am, info.RemoteAddr.String()))
+}
+
+func (a HMACAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
+	err = socks5.ErrAuthMethodNotSupported
+	if am == socks5.AuthHMAC {
+		resultcode := byte(socks5.AuthFailure)
+		if _, err = rw.Write([]byte{socks5.Socks5Version, byte(am)}); err == nil {
+			var hdr [2]byte
+			if _, err = io.ReadFull(rw, hdr[:]); err == nil {
+				if err = socks5.MustEqual(hdr[0], socks5.AuthPrivateVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+					usrBytes := make([]byte, int(hdr[1]))
+					if _, err = io.ReadFull(rw, usrBytes); err == nil {
+						challenge := make([]byte, 1+socks5.HMACChallengeSize)
+						challenge[0] = socks5.AuthPrivateVersion
+						_, _ = rand.Read(challenge[1:])
+						if _, err = rw.Write(challenge); err == nil {
+							response := make([]byte, 1+sha256.Size)
+							if _, err = io.ReadFull(rw, response); err == nil {
+								if err = socks5.MustEqual(response[0], socks5.AuthPrivateVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+									usr := string(usrBytes)
+									err = socks5.ErrAuthFailed
+									if secret, ok := a.lookupSecret(usr, address); ok {
+										if hmac.Equal(response[1:], socks5.HMACResponse(secret, usr, challenge[1:])) {
+											err = nil
+											resultcode = socks5.AuthSuccess
+											username = usr
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+		_, e := rw.Write([]byte{socks5.AuthPrivateVersion, resultcode})
+		err = socks5.JoinErrs(err, e)
+	}
+	return
+}
+
+func (a HMACAuthenticator) lookupSecret(username, address string) (secret []byte, ok bool) {
+	if a.Secrets != nil {
+		secret, ok = a.Secrets.LookupSecret(username, address)
+	}
+	return
+}
+
+// TokenAuthenticator is used to handle the private socks5.AuthToken method,
+// accepting bearer tokens made by socks5.SignToken with the same Key.
+type TokenAuthenticator struct {
+	Key []byte // HMAC-SHA256 key the tokens are signed with, if empty all attempts fail
+}
+
+var _ ContextAuthenticator = TokenAuthenticator{}
+
+func (a TokenAuthenticator) Socks5AuthenticateContext(_ context.Context, info *ConnInfo, am socks5.AuthMethod) (*Identity, error) {
+	return usernameIdentity(a.Socks5Authenticate(info.Conn, am, info.RemoteAddr.String()))
+}
+
+func (a TokenAuthenticator) Socks5Authenticate(rw io.ReadWriter, am socks5.AuthMethod, address string) (username string, err error) {
+	err = socks5.ErrAuthMethodNotSupported
+	if am == socks5.AuthToken {
+		resultcode := byte(socks5.AuthFailure)
+		if _, err = rw.Write([]byte{socks5.Socks5Version, byte(am)}); err == nil {
+			var hdr [3]byte
+			if _, err = io.ReadFull(rw, hdr[:]); err == nil {
+				if err = socks5.MustEqual(hdr[0], socks5.AuthPrivateVersion, socks5.ErrBadSOCKSAuthVersion); err == nil {
+					token := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+					if _, err = io.ReadFull(rw, token); err == nil {
+						var usr string
+						if usr, err = a.verifyToken(string(token)); err == nil {
+							if err = socks5.MustEqual(usr != "", true, socks5.ErrInvalidToken); err == nil {
+								resultcode = socks5.AuthSuccess
+								username = usr
+							}
+						}
+						if err != nil {
+							err = socks5.JoinErrs(socks5.ErrAuthFailed, err)
+						}
+					}
+				}
+			}
+		}
+		_, e := rw.Write([]byte{socks5.AuthPrivateVersion, resultcode})
+		err = socks5.JoinErrs(err, e)
+	}
+	return
+}
+
+func (a TokenAuthenticator) verifyToken(token string) (username string, err error) {
+	err = socks5.ErrInvalidToken
+	if len(a.Key) > 0 {
+		username, err = socks5.VerifyToken(a.Key, token, time.Now())
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func dialEcho(ctx context.Context, t *testing.T, urlstr, echoaddr string) (err error) {
+	t.Helper()
+	var cli *client.Client
+	if cli, err = client.New(urlstr); err == nil {
+		var conn net.Conn
+		if conn, err = cli.DialContext(ctx, "tcp", echoaddr); err == nil {
+			defer conn.Close()
+			if _, err = conn.Write([]byte("ping")); err == nil {
+				_, err = io.ReadFull(conn, make([]byte, 4))
+			}
+		}
+	}
+	return
+}
+
+func TestServer_HMACAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	creds := server.StaticCredentials{"u": "secret"}
+	sniffer := &sniffingDialer{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{
+			server.HMACAuthenticator{Secrets: creds},
+			server.UserPassAuthenticator{Credentials: creds},
+		},
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:secret@" + listen.Addr().String() + "?auth=hmac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.ProxyDialer = sniffer
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if s := sniffer.String(); strings.Contains(s, "secret") {
+		t.Errorf("%q", s)
+	}
+
+	if err = dialEcho(ctx, t, "socks5h://u:wrong@"+listen.Addr().String()+"?auth=hmac", echo.Addr().String()); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+	if err = dialEcho(ctx, t, "socks5h://x:secret@"+listen.Addr().String()+"?auth=hmac", echo.Addr().String()); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+	// clients that only do username/password still work
+	if err = dialEcho(ctx, t, "socks5h://u:secret@"+listen.Addr().String(), echo.Addr().String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_TokenAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	key := []byte("signing key")
+	acct := &recordingAccounter{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.TokenAuthenticator{Key: key}},
+		Accounter:      acct,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	token := socks5.SignToken(key, "joe", time.Now().Add(time.Minute))
+	if err := dialEcho(ctx, t, "socks5h://:"+token+"@"+listen.Addr().String()+"?auth=token", echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := acct.final(ctx); rec.Username != "joe" {
+		t.Errorf("%+v", rec)
+	}
+
+	expired := socks5.SignToken(key, "joe", time.Now().Add(-time.Minute))
+	if err := dialEcho(ctx, t, "socks5h://:"+expired+"@"+listen.Addr().String()+"?auth=token", echo.Addr().String()); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+	forged := socks5.SignToken([]byte("other key"), "joe", time.Now().Add(time.Minute))
+	if err := dialEcho(ctx, t, "socks5h://:"+forged+"@"+listen.Addr().String()+"?auth=token", echo.Addr().String()); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+}
+
+func TestServer_PrefersPrivateAuthMethod(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	creds := server.StaticCredentials{"u": "secret"}
+	reh := &recordingEventHandler{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{
+			server.UserPassAuthenticator{Credentials: creds},
+			server.HMACAuthenticator{Secrets: creds},
+		},
+		EventHandler: reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Authenticators = []client.Authenticator{
+		client.UserPassAuthenticator{Username: "u", Password: "secret"},
+		client.HMACAuthenticator{Username: "u", Secret: "secret"},
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventAuthChosen && ev.AuthMethod != socks5.AuthHMAC {
+			t.Error(ev.AuthMethod)
+		}
+	}
+}
+
+func TestServer_HMACAuthenticator_NilSecrets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	srv := &server.Server{Authenticators: []server.Authenticator{server.HMACAuthenticator{}}}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	if err := dialEcho(ctx, t, "socks5h://u:secret@"+listen.Addr().String()+"?auth=hmac", "127.0.0.1:1"); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+}
+
+func TestServer_TokenAuthenticator_NoKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	srv := &server.Server{Authenticators: []server.Authenticator{server.TokenAuthenticator{}}}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	token := socks5.SignToken(nil, "admin", time.Now().Add(time.Minute))
+	if err := dialEcho(ctx, t, "socks5h://:"+token+"@"+listen.Addr().String()+"?auth=token", "127.0.0.1:1"); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+}
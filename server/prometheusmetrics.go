@@ -0,0 +1,186 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram bucket upper bounds used by PrometheusMetrics if Buckets is nil.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a Metrics implementation that keeps the values in memory
+// and serves them in the Prometheus text exposition format.
+//
+// A metric name must always be used with the same kind of metric; mismatched
+// updates are ignored.
+type PrometheusMetrics struct {
+	Buckets  []float64 // sorted histogram bucket upper bounds, if nil DefaultBuckets is used
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+var _ Metrics = &PrometheusMetrics{}
+var _ http.Handler = &PrometheusMetrics{}
+
+type metricFamily struct {
+	kind   string                   // "counter", "gauge" or "histogram"
+	series map[string]*metricSeries // keyed by formatted labels
+}
+
+type metricSeries struct {
+	value   float64  // counter or gauge value, or sum of histogram observations
+	count   uint64   // number of histogram observations
+	buckets []uint64 // histogram observations per bucket, not cumulative
+}
+
+// formatLabels returns the labels as `name="value"` pairs separated by commas.
+func formatLabels(labels []string) string {
+	var sb strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+func (pm *PrometheusMetrics) seriesLocked(kind, name string, labels []string) (ms *metricSeries) {
+	if pm.families == nil {
+		pm.families = make(map[string]*metricFamily)
+	}
+	mf := pm.families[name]
+	if mf == nil {
+		mf = &metricFamily{kind: kind, series: make(map[string]*metricSeries)}
+		pm.families[name] = mf
+	}
+	if mf.kind == kind {
+		key := formatLabels(labels)
+		if ms = mf.series[key]; ms == nil {
+			ms = &metricSeries{}
+			if kind == "histogram" {
+				ms.buckets = make([]uint64, len(pm.buckets()))
+			}
+			mf.series[key] = ms
+		}
+	}
+	return
+}
+
+func (pm *PrometheusMetrics) buckets() (b []float64) {
+	if b = pm.Buckets; b == nil {
+		b = DefaultBuckets
+	}
+	return
+}
+
+func (pm *PrometheusMetrics) AddCounter(name string, delta float64, labels ...string) {
+	if delta >= 0 {
+		pm.mu.Lock()
+		defer pm.mu.Unlock()
+		if ms := pm.seriesLocked("counter", name, labels); ms != nil {
+			ms.value += delta
+		}
+	}
+}
+
+func (pm *PrometheusMetrics) AddGauge(name string, delta float64, labels ...string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if ms := pm.seriesLocked("gauge", name, labels); ms != nil {
+		ms.value += delta
+	}
+}
+
+func (pm *PrometheusMetrics) Observe(name string, value float64, labels ...string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if ms := pm.seriesLocked("histogram", name, labels); ms != nil {
+		ms.value += value
+		ms.count++
+		for i, le := range pm.buckets() {
+			if value <= le {
+				ms.buckets[i]++
+				break
+			}
+		}
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeSample(sb *strings.Builder, name, labels, value string) {
+	sb.WriteString(name)
+	if labels != "" {
+		sb.WriteByte('{')
+		sb.WriteString(labels)
+		sb.WriteByte('}')
+	}
+	sb.WriteByte(' ')
+	sb.WriteString(value)
+	sb.WriteByte('\n')
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+// String returns the metrics in the Prometheus text exposition format.
+func (pm *PrometheusMetrics) String() string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	var sb strings.Builder
+	names := make([]string, 0, len(pm.families))
+	for name := range pm.families {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		mf := pm.families[name]
+		sb.WriteString("# TYPE " + name + " " + mf.kind + "\n")
+		keys := make([]string, 0, len(mf.series))
+		for key := range mf.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			ms := mf.series[key]
+			if mf.kind == "histogram" {
+				var cumulative uint64
+				for i, le := range pm.buckets() {
+					if i < len(ms.buckets) {
+						cumulative += ms.buckets[i]
+					}
+					writeSample(&sb, name+"_bucket", joinLabels(key, `le="`+formatFloat(le)+`"`), strconv.FormatUint(cumulative, 10))
+				}
+				writeSample(&sb, name+"_bucket", joinLabels(key, `le="+Inf"`), strconv.FormatUint(ms.count, 10))
+				writeSample(&sb, name+"_sum", key, formatFloat(ms.value))
+				writeSample(&sb, name+"_count", key, strconv.FormatUint(ms.count, 10))
+			} else {
+				writeSample(&sb, name, key, formatFloat(ms.value))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (pm *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = w.Write([]byte(pm.String()))
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/linkdata/socks5"
+)
+
+// ErrSessionLimit is returned, together with socks5.ErrReplyConnectionNotAllowed, when a session limit is reached.
+var ErrSessionLimit = errors.New("session limit reached")
+
+type quota struct {
+	key   string
+	limit int
+}
+
+// acquireQuotas counts the session against the session limits. If a limit is
+// reached, nothing is counted and an error is returned. Otherwise the returned
+// function must be called when the session ends.
+//
+// The user limit for anonymous sessions is counted per source address rather
+// than for all anonymous clients together.
+func (sess *session) acquireQuotas() (release func(), err error) {
+	release = func() {}
+	host, _, _ := net.SplitHostPort(sess.conn.RemoteAddr().String())
+	userKey := "user:" + sess.username
+	if sess.username == "" {
+		userKey = "anonymous:" + host
+	}
+	quotas := []quota{
+		{"", sess.MaxSessions},
+		{userKey, sess.MaxSessionsPerUser},
+		{"source:" + host, sess.MaxSessionsPerSource},
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	for _, q := range quotas {
+		if q.limit > 0 && sess.quotas[q.key] >= q.limit {
+			return release, errors.Join(socks5.ErrReplyConnectionNotAllowed, socks5.Note(ErrSessionLimit, q.key))
+		}
+	}
+	if sess.quotas == nil {
+		sess.quotas = make(map[string]int)
+	}
+	for _, q := range quotas {
+		if q.limit > 0 {
+			sess.quotas[q.key]++
+		}
+	}
+	release = func() {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		for _, q := range quotas {
+			if q.limit > 0 {
+				if sess.quotas[q.key]--; sess.quotas[q.key] < 1 {
+					delete(sess.quotas, q.key)
+				}
+			}
+		}
+	}
+	return
+}
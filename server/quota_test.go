@@ -0,0 +1,134 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func testSessionLimit(t *testing.T, srv *server.Server) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	srv.Authenticators = []server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"u": "p"}}}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://u:p@" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", echo.Addr().String()); !errors.Is(err, socks5.ErrReplyConnectionNotAllowed) {
+		t.Error(err)
+	}
+	_ = conn.Close()
+	for ctx.Err() == nil {
+		if conn, err = cli.DialContext(ctx, "tcp", echo.Addr().String()); err == nil {
+			_ = conn.Close()
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_MaxSessions(t *testing.T) {
+	testSessionLimit(t, &server.Server{MaxSessions: 1})
+}
+
+func TestServer_MaxSessionsPerUser(t *testing.T) {
+	testSessionLimit(t, &server.Server{MaxSessionsPerUser: 1})
+}
+
+func TestServer_MaxSessionsPerUser_Anonymous(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen := startServer(t, ctx, &server.Server{MaxSessionsPerUser: 1})
+	defer listen.Close()
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	// anonymous sessions from different sources don't share a limit
+	for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		cli, err := client.New("socks5h://" + listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.ProxyDialer = &net.Dialer{LocalAddr: &net.TCPAddr{IP: ip}}
+		conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(ip, err)
+		}
+		conns = append(conns, conn)
+		if _, err = cli.DialContext(ctx, "tcp", echo.Addr().String()); !errors.Is(err, socks5.ErrReplyConnectionNotAllowed) {
+			t.Error(ip, err)
+		}
+	}
+}
+
+func TestServer_MaxSessionsPerSource(t *testing.T) {
+	testSessionLimit(t, &server.Server{MaxSessionsPerSource: 1})
+}
+
+func TestServer_MaxUDPTargets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo1 := startUDPEchoServer(t)
+	defer echo1.Close()
+	echo2 := startUDPEchoServer(t)
+	defer echo2.Close()
+
+	listen := startServer(t, ctx, &server.Server{MaxUDPTargets: 1})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "udp", echo1.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pc := conn.(net.PacketConn)
+
+	buf := make([]byte, 16)
+	if _, err = pc.WriteTo([]byte("1"), echo1.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = pc.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.WriteTo([]byte("2"), echo2.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, _, err = pc.ReadFrom(buf); err == nil {
+		t.Error("expected timeout")
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+// RateLimit is a bandwidth limit in bytes per second. Zero means unlimited.
+type RateLimit struct {
+	Up   int64 // from client to targets
+	Down int64 // from targets to client
+}
+
+// RateLimiter provides bandwidth limits.
+//
+// Each limit is a token bucket shared by all concurrent sessions it applies to.
+// TCP relays are slowed down to stay within the limits, while UDP datagrams
+// exceeding them are dropped. Datagrams larger than a limit pass when its bucket is full.
+type RateLimiter interface {
+	// UserRateLimit returns the limit shared by all sessions of username.
+	// If username is the empty string, AuthMethodNone was used, and the limit
+	// is shared by the anonymous sessions from each source IP address.
+	UserRateLimit(username string) RateLimit
+	// SourceRateLimit returns the limit shared by all sessions from the source IP address.
+	SourceRateLimit(ip string) RateLimit
+}
+
+// StaticRateLimits is a RateLimiter with fixed limits.
+type StaticRateLimits struct {
+	Users  map[string]RateLimit // per-user limits
+	User   RateLimit            // limit for users not found in Users
+	Source RateLimit            // limit per source IP address
+}
+
+func (srl StaticRateLimits) UserRateLimit(username string) RateLimit {
+	if rl, ok := srl.Users[username]; ok {
+		return rl
+	}
+	return srl.User
+}
+
+func (srl StaticRateLimits) SourceRateLimit(ip string) RateLimit {
+	return srl.Source
+}
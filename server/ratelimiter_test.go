@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func TestStaticRateLimits(t *testing.T) {
+	srl := server.StaticRateLimits{
+		Users:  map[string]server.RateLimit{"u": {Up: 1, Down: 2}},
+		User:   server.RateLimit{Up: 3},
+		Source: server.RateLimit{Down: 4},
+	}
+	if x := srl.UserRateLimit("u"); x != (server.RateLimit{Up: 1, Down: 2}) {
+		t.Error(x)
+	}
+	if x := srl.UserRateLimit(""); x != (server.RateLimit{Up: 3}) {
+		t.Error(x)
+	}
+	if x := srl.SourceRateLimit("127.0.0.1"); x != (server.RateLimit{Down: 4}) {
+		t.Error(x)
+	}
+}
+
+func TestServer_RateLimiter(t *testing.T) {
+	const rate = 100000
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	srv := &server.Server{RateLimiter: server.StaticRateLimits{User: server.RateLimit{Down: rate}}}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two sessions share the limit, so after the initial burst
+	// the remaining rate bytes take at least a second
+	started := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			go func() { _, _ = conn.Write(make([]byte, rate)) }()
+			if _, err = io.ReadFull(conn, make([]byte, rate)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(started); elapsed < time.Millisecond*900 {
+		t.Error("too fast", elapsed)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+const relayBufferSize = 32 * 1024
+
+// relay copies data in both directions between the client and target until either
+// side is done, an error occurs or no data has been relayed for IdleTimeout.
+// It also ends when ctx is done. Both connections are closed and both directions
+// have stopped when it returns.
+func (sess *session) relay(ctx context.Context, target net.Conn) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { _ = target.Close() })
+	defer stop()
+	sess.touch()
+	errc := make(chan error, 2)
+	go func() {
+		errc <- socks5.Note(sess.copyData(ctx, sess.conn, target, false), "from backend to client")
+	}()
+	go func() {
+		errc <- socks5.Note(sess.copyData(ctx, target, sess.conn, true), "from client to backend")
+	}()
+	err = <-errc
+	cancel()
+	_ = target.Close()
+	_ = sess.conn.Close()
+	<-errc
+	return
+}
+
+// copyData copies from src to dst, counting and rate limiting the bytes copied
+// as being sent from the client if up is true, or to the client otherwise.
+//
+// Without rate limits, IdleTimeout or interim accounting, io.Copy is used so the operating
+// system can copy the data directly, and the bytes are counted when it returns.
+// Waiting for the rate limits ends when ctx is done.
+func (sess *session) copyData(ctx context.Context, dst, src net.Conn, up bool) (err error) {
+	if len(sess.rates) == 0 && sess.IdleTimeout <= 0 && (sess.Accounter == nil || sess.AccountingInterval <= 0) {
+		var n int64
+		n, err = io.Copy(dst, src)
+		sess.addBytes(int(n), up)
+		return
+	}
+	buf := make([]byte, sess.chunkSize(up))
+	for err == nil {
+		if sess.IdleTimeout > 0 {
+			_ = src.SetReadDeadline(time.Now().Add(sess.IdleTimeout))
+		}
+		var n int
+		n, err = src.Read(buf)
+		if n > 0 {
+			sess.touch()
+			if err = sess.throttle(ctx, n, up); err == nil {
+				var nn int
+				if nn, err = dst.Write(buf[:n]); err == nil {
+					err = socks5.MustEqual(nn, n, io.ErrShortWrite)
+				}
+				sess.addBytes(nn, up)
+			}
+		}
+		if sess.IdleTimeout > 0 && isTimeout(err) && sess.idle() < sess.IdleTimeout {
+			// the other direction has seen traffic
+			err = nil
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
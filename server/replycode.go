@@ -0,0 +1,32 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/linkdata/socks5"
+)
+
+// replyCode returns the reply code to send to the client for err.
+//
+// A socks5.ReplyError anywhere in the error chain is used as-is. Otherwise
+// refused connections, unreachable networks and hosts, DNS failures and
+// timeouts are mapped to their respective reply codes.
+func replyCode(err error) (code socks5.ReplyCode) {
+	var re socks5.ReplyError
+	var dnserr *net.DNSError
+	switch {
+	case err == nil:
+		code = socks5.ReplySuccess
+	case errors.As(err, &re):
+		code = re.ReplyCode
+	case errnoReplyCode(err, &code):
+	case errors.As(err, &dnserr) && !dnserr.IsTimeout:
+		code = socks5.ReplyHostUnreachable
+	case isTimeout(err):
+		code = socks5.ReplyTTLExpired
+	default:
+		code = socks5.ReplyGeneralFailure
+	}
+	return
+}
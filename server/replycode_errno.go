@@ -0,0 +1,26 @@
+//go:build !plan9
+
+package server
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/linkdata/socks5"
+)
+
+// errnoReplyCode sets code and returns true if err wraps a system error with a matching reply code.
+func errnoReplyCode(err error, code *socks5.ReplyCode) (ok bool) {
+	ok = true
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		*code = socks5.ReplyConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		*code = socks5.ReplyNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		*code = socks5.ReplyHostUnreachable
+	default:
+		ok = false
+	}
+	return
+}
@@ -0,0 +1,31 @@
+//go:build !plan9
+
+package server
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/linkdata/socks5"
+)
+
+func Test_errnoReplyCode(t *testing.T) {
+	tests := []struct {
+		errno syscall.Errno
+		want  socks5.ReplyCode
+	}{
+		{syscall.ECONNREFUSED, socks5.ReplyConnectionRefused},
+		{syscall.ENETUNREACH, socks5.ReplyNetworkUnreachable},
+		{syscall.EHOSTUNREACH, socks5.ReplyHostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.errno.Error(), func(t *testing.T) {
+			err := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", tt.errno)}
+			if got := replyCode(err); got != tt.want {
+				t.Errorf("replyCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package server
+
+import "github.com/linkdata/socks5"
+
+// errnoReplyCode always returns false on Plan 9, which has no errno values.
+func errnoReplyCode(err error, code *socks5.ReplyCode) (ok bool) {
+	return
+}
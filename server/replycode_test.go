@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/linkdata/socks5"
+)
+
+func Test_replyCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want socks5.ReplyCode
+	}{
+		{"nil", nil, socks5.ReplySuccess},
+		{"ReplyError", socks5.ErrReplyCommandNotSupported, socks5.ReplyCommandNotSupported},
+		{"noted ReplyError", socks5.Note(socks5.ErrReplyConnectionNotAllowed, "x"), socks5.ReplyConnectionNotAllowed},
+		{"dns not found", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, socks5.ReplyHostUnreachable},
+		{"dns timeout", &net.DNSError{Err: "timeout", IsTimeout: true}, socks5.ReplyTTLExpired},
+		{"deadline", context.DeadlineExceeded, socks5.ReplyTTLExpired},
+		{"i/o timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, socks5.ReplyTTLExpired},
+		{"other", errors.New("other"), socks5.ReplyGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCode(tt.err); got != tt.want {
+				t.Errorf("replyCode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
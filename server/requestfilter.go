@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/linkdata/socks5"
+)
+
+// RequestFilter decides if a client request may proceed.
+type RequestFilter interface {
+	// FilterRequest returns nil if the request is allowed.
+	//
+	// When called, client has already logged in. If username is the empty string, AuthMethodNone was used.
+	// The source is the client network address and address is the target host and port.
+	// For ASSOCIATE, FilterRequest is called once for every new target of the association.
+	//
+	// To deny a request, return socks5.ErrReplyConnectionNotAllowed, or another of the
+	// socks5.ErrReply... errors, as those will be mapped to SOCKS5 error codes in the reply to the client.
+	FilterRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) error
+}
+
+// ResolvingRequestFilter is a RequestFilter that resolves domain names to check the addresses they resolve to.
+type ResolvingRequestFilter interface {
+	RequestFilter
+	// ResolveRequest is like FilterRequest, but if the request is allowed and the target is a domain name,
+	// it also returns the addresses that were checked. The server connects to those rather than
+	// resolving the name again, which could give a different answer.
+	ResolveRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) (ips []netip.Addr, err error)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"sync"
+
+	"github.com/linkdata/socks5"
+)
+
+// RuleFile is a RequestFilter using a RuleSet read from a JSON file.
+//
+// Requests are checked against the latest version of the file, so rules can be edited on
+// a running server. If an edit doesn't parse, the rules loaded before it keep being
+// enforced and Reload reports the error. Without any valid rules, every request is denied.
+type RuleFile struct {
+	Path                string // path to JSON encoded RuleSet
+	socks5.HostLookuper        // resolver to use, nil for net.DefaultResolver
+	mu                  sync.Mutex
+	watcher             fileWatcher
+	rules               *RuleSet
+	err                 error // last load error
+}
+
+var _ ResolvingRequestFilter = &RuleFile{}
+
+// NewRuleFile returns a RuleFile with the rules loaded from the file at path.
+func NewRuleFile(path string) (rf *RuleFile, err error) {
+	rf = &RuleFile{Path: path}
+	if err = rf.Reload(); err != nil {
+		rf = nil
+	}
+	return
+}
+
+func (rf *RuleFile) loadLocked(force bool) {
+	changed, err := rf.watcher.changed(rf.Path, force)
+	if err == nil && changed {
+		var f *os.File
+		if f, err = os.Open(rf.Path); err == nil {
+			defer f.Close()
+			var rs *RuleSet
+			if rs, err = ReadRuleSet(f); err == nil {
+				rf.rules = rs
+			}
+		}
+	}
+	if changed || err != nil {
+		rf.err = err
+	}
+}
+
+// Reload reads the file even if it has not changed, and returns any error encountered.
+func (rf *RuleFile) Reload() (err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.loadLocked(true)
+	return rf.err
+}
+
+// RuleSet returns the currently loaded rules, reloading them first if the file has changed.
+func (rf *RuleFile) RuleSet() (rs *RuleSet, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.loadLocked(false)
+	if rs = rf.rules; rs == nil {
+		err = rf.err
+	}
+	return
+}
+
+func (rf *RuleFile) FilterRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) (err error) {
+	_, err = rf.ResolveRequest(ctx, username, source, cmd, address)
+	return
+}
+
+func (rf *RuleFile) ResolveRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) (ips []netip.Addr, err error) {
+	var rs *RuleSet
+	if rs, err = rf.RuleSet(); err == nil {
+		if rf.HostLookuper != nil {
+			tmp := *rs
+			tmp.HostLookuper = rf.HostLookuper
+			rs = &tmp
+		}
+		ips, err = rs.ResolveRequest(ctx, username, source, cmd, address)
+	} else {
+		err = socks5.JoinErrs(socks5.ErrReplyConnectionNotAllowed, err)
+	}
+	return
+}
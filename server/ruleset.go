@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/linkdata/socks5"
+)
+
+var (
+	ErrInvalidRuleAction = errors.New("invalid rule action")
+	ErrInvalidPortRange  = errors.New("invalid port range")
+)
+
+// RuleAction is what to do with a request matching a Rule.
+type RuleAction byte
+
+const (
+	RuleAllow RuleAction = 0 // allow the request
+	RuleDeny  RuleAction = 1 // deny the request with socks5.ErrReplyConnectionNotAllowed
+)
+
+var _ encoding.TextMarshaler = RuleAction(0)
+var _ encoding.TextUnmarshaler = (*RuleAction)(nil)
+
+func (ra RuleAction) String() string {
+	if ra == RuleAllow {
+		return "allow"
+	}
+	return "deny"
+}
+
+func (ra RuleAction) MarshalText() ([]byte, error) {
+	return []byte(ra.String()), nil
+}
+
+func (ra *RuleAction) UnmarshalText(text []byte) (err error) {
+	err = ErrInvalidRuleAction
+	for _, v := range []RuleAction{RuleAllow, RuleDeny} {
+		if strings.EqualFold(v.String(), string(text)) {
+			*ra = v
+			err = nil
+		}
+	}
+	return
+}
+
+// PortRange is an inclusive range of port numbers.
+// In text form it is either a single port ("80") or a range ("8000-8100").
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+var _ encoding.TextMarshaler = PortRange{}
+var _ encoding.TextUnmarshaler = (*PortRange)(nil)
+
+func (pr PortRange) Contains(port uint16) bool {
+	return port >= pr.Low && port <= pr.High
+}
+
+func (pr PortRange) String() string {
+	s := strconv.Itoa(int(pr.Low))
+	if pr.High != pr.Low {
+		s += "-" + strconv.Itoa(int(pr.High))
+	}
+	return s
+}
+
+func (pr PortRange) MarshalText() ([]byte, error) {
+	return []byte(pr.String()), nil
+}
+
+func (pr *PortRange) UnmarshalText(text []byte) (err error) {
+	low, high, found := strings.Cut(string(text), "-")
+	if !found {
+		high = low
+	}
+	var lo, hi uint64
+	if lo, err = strconv.ParseUint(low, 10, 16); err == nil {
+		if hi, err = strconv.ParseUint(high, 10, 16); err == nil {
+			if err = socks5.MustEqual(lo <= hi, true, ErrInvalidPortRange); err == nil {
+				pr.Low = uint16(lo)
+				pr.High = uint16(hi)
+			}
+		}
+	}
+	if err != nil {
+		err = ErrInvalidPortRange
+	}
+	return
+}
+
+// Rule matches requests. Empty criteria match anything, and a rule matches a request
+// if all of its non-empty criteria match.
+//
+// Destinations and Domains together form the destination criterion, and if both are
+// given the rule matches if either of them does. Domain names are matched against
+// Destinations using the addresses they resolve to.
+type Rule struct {
+	Action       RuleAction           `json:"action"`
+	Users        []string             `json:"users,omitempty"`        // usernames, the empty string matches anonymous users
+	Sources      []netip.Prefix       `json:"sources,omitempty"`      // client networks
+	Destinations []netip.Prefix       `json:"destinations,omitempty"` // target networks
+	Domains      []string             `json:"domains,omitempty"`      // target domain name patterns, see path.Match
+	Ports        []PortRange          `json:"ports,omitempty"`        // target ports
+	Commands     []socks5.CommandType `json:"commands,omitempty"`     // CONNECT, BIND or ASSOCIATE
+}
+
+// ruleRequest is a request being matched against a RuleSet.
+type ruleRequest struct {
+	username string
+	source   netip.Addr
+	cmd      socks5.CommandType
+	domain   string     // target domain name, lower case, empty if target was an IP address
+	ip       netip.Addr // target IP address, invalid if unknown
+	port     uint16
+}
+
+func prefixesContain(prefixes []netip.Prefix, ip netip.Addr) bool {
+	if ip.IsValid() {
+		for _, p := range prefixes {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchDestination(req *ruleRequest) bool {
+	if len(r.Destinations) == 0 && len(r.Domains) == 0 {
+		return true
+	}
+	if prefixesContain(r.Destinations, req.ip) {
+		return true
+	}
+	if req.domain != "" {
+		for _, pattern := range r.Domains {
+			if ok, _ := path.Match(strings.ToLower(pattern), req.domain); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) match(req *ruleRequest) bool {
+	return (len(r.Users) == 0 || slices.Contains(r.Users, req.username)) &&
+		(len(r.Commands) == 0 || slices.Contains(r.Commands, req.cmd)) &&
+		(len(r.Sources) == 0 || prefixesContain(r.Sources, req.source)) &&
+		(len(r.Ports) == 0 || slices.ContainsFunc(r.Ports, func(pr PortRange) bool { return pr.Contains(req.port) })) &&
+		r.matchDestination(req)
+}
+
+// isPrivate returns true for addresses that should not be reachable through the proxy by default.
+func isPrivate(ip netip.Addr) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// RuleSet is a RequestFilter that allows or denies requests based on a list of rules.
+//
+// Rules are evaluated in order and the first matching rule decides. If no rule
+// matches, Default decides.
+//
+// Unless AllowPrivate is set, CONNECT and ASSOCIATE targets in loopback, private,
+// link-local or unspecified address ranges are denied, protecting against
+// server-side request forgery. Such targets are only allowed if the first matching
+// rule is an allow rule whose Destinations contain them.
+//
+// Domain names are resolved using HostLookuper and every resolved address must be
+// allowed. The server then connects to the checked addresses rather than the name.
+// Unless AllowPrivate is set, CONNECT and ASSOCIATE targets that fail to resolve are denied.
+//
+// A RuleSet must not be modified while in use.
+type RuleSet struct {
+	Rules               []Rule     `json:"rules"`
+	Default             RuleAction `json:"default"`                // action if no rule matches
+	AllowPrivate        bool       `json:"allowPrivate,omitempty"` // if true, private and loopback targets are not denied by default
+	socks5.HostLookuper `json:"-"` // resolver to use, nil for net.DefaultResolver
+}
+
+var _ ResolvingRequestFilter = &RuleSet{}
+
+// ReadRuleSet reads a JSON encoded RuleSet.
+func ReadRuleSet(r io.Reader) (rs *RuleSet, err error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var tmp RuleSet
+	if err = dec.Decode(&tmp); err == nil {
+		rs = &tmp
+	}
+	return
+}
+
+func (rs *RuleSet) resolver() (hl socks5.HostLookuper) {
+	if hl = rs.HostLookuper; hl == nil {
+		hl = net.DefaultResolver
+	}
+	return
+}
+
+func (rs *RuleSet) decide(req *ruleRequest) (allowed bool) {
+	var rule *Rule
+	for i := range rs.Rules {
+		if rs.Rules[i].match(req) {
+			rule = &rs.Rules[i]
+			break
+		}
+	}
+	if !rs.AllowPrivate && req.cmd != socks5.CommandBind && isPrivate(req.ip) {
+		return rule != nil && rule.Action == RuleAllow && prefixesContain(rule.Destinations, req.ip)
+	}
+	if rule != nil {
+		return rule.Action == RuleAllow
+	}
+	return rs.Default == RuleAllow
+}
+
+// lookup returns the addresses the domain name resolves to, or nil if it can't be resolved.
+func (rs *RuleSet) lookup(ctx context.Context, domain string) (ips []netip.Addr) {
+	if addrs, err := rs.resolver().LookupHost(ctx, domain); err == nil {
+		for _, s := range addrs {
+			if ip, err := netip.ParseAddr(s); err == nil {
+				ips = append(ips, ip.Unmap())
+			}
+		}
+	}
+	return
+}
+
+func (rs *RuleSet) FilterRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) (err error) {
+	_, err = rs.ResolveRequest(ctx, username, source, cmd, address)
+	return
+}
+
+func (rs *RuleSet) ResolveRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) (ips []netip.Addr, err error) {
+	var host string
+	var port uint16
+	if host, port, err = socks5.SplitHostPort(address); err == nil {
+		req := ruleRequest{
+			username: username,
+			cmd:      cmd,
+			port:     port,
+		}
+		if ap, e := netip.ParseAddrPort(source); e == nil {
+			req.source = ap.Addr().Unmap()
+		}
+		var checked []netip.Addr
+		if ip, e := netip.ParseAddr(host); e == nil {
+			checked = append(checked, ip.Unmap())
+		} else {
+			req.domain = strings.ToLower(strings.TrimSuffix(host, "."))
+			if cmd != socks5.CommandBind {
+				ips = rs.lookup(ctx, req.domain)
+				checked = ips
+			}
+		}
+		allowed := true
+		if len(checked) == 0 {
+			// unresolved names could still reach private addresses when dialed
+			allowed = (req.domain == "" || cmd == socks5.CommandBind || rs.AllowPrivate) && rs.decide(&req)
+		}
+		for _, ip := range checked {
+			req.ip = ip
+			allowed = allowed && rs.decide(&req)
+		}
+		if !allowed {
+			ips, err = nil, socks5.ErrReplyConnectionNotAllowed
+		}
+	}
+	return
+}
@@ -0,0 +1,284 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type staticLookuper map[string][]string
+
+func (sl staticLookuper) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	var ok bool
+	if addrs, ok = sl[host]; !ok {
+		err = errors.New("no such host")
+	}
+	return
+}
+
+var testLookuper = staticLookuper{
+	"www.example.com":      {"93.184.215.14"},
+	"internal.example.com": {"10.1.2.3"},
+	"mixed.example.com":    {"93.184.215.14", "127.0.0.1"},
+	"foo.allowed.com":      {"203.0.113.5"},
+}
+
+func TestRuleSet_FilterRequest(t *testing.T) {
+	rs := &server.RuleSet{
+		Rules: []server.Rule{
+			{Action: server.RuleDeny, Users: []string{"mallory"}},
+			{Action: server.RuleDeny, Commands: []socks5.CommandType{socks5.CommandBind}, Sources: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}},
+			{Action: server.RuleAllow, Destinations: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, Users: []string{"admin"}},
+			{Action: server.RuleDeny, Domains: []string{"*.blocked.com"}},
+			{Action: server.RuleDeny, Ports: []server.PortRange{{Low: 25, High: 25}, {Low: 6000, High: 6100}}},
+			{Action: server.RuleAllow, Destinations: []netip.Prefix{netip.MustParsePrefix("93.184.0.0/16")}, Domains: []string{"*.allowed.com"}},
+		},
+		Default:      server.RuleDeny,
+		HostLookuper: testLookuper,
+	}
+	tests := []struct {
+		name     string
+		username string
+		source   string
+		cmd      socks5.CommandType
+		address  string
+		allowed  bool
+	}{
+		{"allowed ip", "", "1.2.3.4:1", socks5.CommandConnect, "93.184.215.14:443", true},
+		{"allowed domain", "", "1.2.3.4:1", socks5.CommandConnect, "www.example.com:443", true},
+		{"allowed domain glob", "", "1.2.3.4:1", socks5.CommandConnect, "foo.allowed.com:443", true},
+		{"default deny", "", "1.2.3.4:1", socks5.CommandConnect, "8.8.8.8:53", false},
+		{"denied user", "mallory", "1.2.3.4:1", socks5.CommandConnect, "93.184.215.14:443", false},
+		{"denied domain glob", "", "1.2.3.4:1", socks5.CommandConnect, "WWW.Blocked.Com:443", false},
+		{"denied port", "", "1.2.3.4:1", socks5.CommandConnect, "93.184.215.14:25", false},
+		{"denied port range", "", "1.2.3.4:1", socks5.CommandAssociate, "93.184.215.14:6050", false},
+		{"denied bind from source", "", "192.168.1.1:1", socks5.CommandBind, "93.184.215.14:80", false},
+		{"allowed bind from other source", "", "[::ffff:1.2.3.4]:1", socks5.CommandBind, "93.184.215.14:80", true},
+		{"private denied", "", "1.2.3.4:1", socks5.CommandConnect, "10.1.2.3:80", false},
+		{"private domain denied", "", "1.2.3.4:1", socks5.CommandConnect, "internal.example.com:80", false},
+		{"loopback denied", "", "1.2.3.4:1", socks5.CommandConnect, "[::1]:80", false},
+		{"any resolved private denied", "", "1.2.3.4:1", socks5.CommandConnect, "mixed.example.com:80", false},
+		{"private explicitly allowed", "admin", "1.2.3.4:1", socks5.CommandConnect, "internal.example.com:80", true},
+		{"unresolvable denied", "", "1.2.3.4:1", socks5.CommandConnect, "nosuchhost.test:80", false},
+		{"unresolvable allowed domain denied", "", "1.2.3.4:1", socks5.CommandConnect, "bar.allowed.com:80", false},
+		{"unresolvable bind allowed", "", "1.2.3.4:1", socks5.CommandBind, "bar.allowed.com:80", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rs.FilterRequest(context.Background(), tt.username, tt.source, tt.cmd, tt.address)
+			if tt.allowed && err != nil {
+				t.Error(err)
+			}
+			if !tt.allowed && err != socks5.ErrReplyConnectionNotAllowed {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestRuleSet_AllowPrivate(t *testing.T) {
+	rs := &server.RuleSet{AllowPrivate: true}
+	if err := rs.FilterRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandConnect, "127.0.0.1:80"); err != nil {
+		t.Error(err)
+	}
+	rs.HostLookuper = testLookuper
+	if err := rs.FilterRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandConnect, "nosuchhost.test:80"); err != nil {
+		t.Error(err)
+	}
+	rs.AllowPrivate = false
+	if err := rs.FilterRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandBind, "0.0.0.0:0"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRuleSet_ResolveRequest(t *testing.T) {
+	rs := &server.RuleSet{Default: server.RuleAllow, HostLookuper: testLookuper}
+	ips, err := rs.ResolveRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandConnect, "www.example.com:443")
+	if err != nil || len(ips) != 1 || ips[0] != netip.MustParseAddr("93.184.215.14") {
+		t.Error(ips, err)
+	}
+	if ips, err = rs.ResolveRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandConnect, "93.184.215.14:443"); err != nil || ips != nil {
+		t.Error(ips, err)
+	}
+	if ips, err = rs.ResolveRequest(context.Background(), "", "1.2.3.4:1", socks5.CommandConnect, "mixed.example.com:443"); err == nil || ips != nil {
+		t.Error(ips, err)
+	}
+}
+
+func TestReadRuleSet(t *testing.T) {
+	rs, err := server.ReadRuleSet(strings.NewReader(`{
+		"rules": [
+			{"action": "deny", "commands": ["bind", "ASSOCIATE"], "ports": ["80", "8000-8100"]},
+			{"action": "allow", "sources": ["10.0.0.0/8"], "destinations": ["::1/128"], "domains": ["*.example.com"]}
+		],
+		"default": "deny",
+		"allowPrivate": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Rules) != 2 || rs.Default != server.RuleDeny || !rs.AllowPrivate {
+		t.Errorf("%+v", rs)
+	}
+	if x := rs.Rules[0].Ports[1]; x != (server.PortRange{Low: 8000, High: 8100}) {
+		t.Error(x)
+	}
+	if x := rs.Rules[0].Commands[1]; x != socks5.CommandAssociate {
+		t.Error(x)
+	}
+	for _, bad := range []string{
+		`{"rules": [{"action": "maybe"}]}`,
+		`{"rules": [{"ports": ["100-10"]}]}`,
+		`{"rules": [{"ports": ["70000"]}]}`,
+		`{"rules": [{"commands": ["jump"]}]}`,
+		`{"unknown": true}`,
+	} {
+		if _, err = server.ReadRuleSet(strings.NewReader(bad)); err == nil {
+			t.Error("expected error for", bad)
+		}
+	}
+}
+
+func TestRuleFile_Reload(t *testing.T) {
+	defer func(old time.Duration) { server.FileCheckInterval = old }(server.FileCheckInterval)
+	server.FileCheckInterval = 0
+
+	fn := filepath.Join(t.TempDir(), "rules.json")
+	if _, err := server.NewRuleFile(fn); err == nil {
+		t.Error("expected error")
+	}
+	if err := os.WriteFile(fn, []byte(`{"default": "allow", "allowPrivate": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := server.NewRuleFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = rf.FilterRequest(ctx, "", "1.2.3.4:1", socks5.CommandConnect, "127.0.0.1:80"); err != nil {
+		t.Error(err)
+	}
+
+	if err = os.WriteFile(fn, []byte(`{"default": "deny"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.FilterRequest(ctx, "", "1.2.3.4:1", socks5.CommandConnect, "127.0.0.1:80"); err != socks5.ErrReplyConnectionNotAllowed {
+		t.Error(err)
+	}
+
+	// invalid file keeps the previous rules
+	if err = os.WriteFile(fn, []byte(`{"default": "allow", "allowPrivate": true, }`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = rf.Reload(); err == nil {
+		t.Error("expected error")
+	}
+	if err = rf.FilterRequest(ctx, "", "1.2.3.4:1", socks5.CommandConnect, "127.0.0.1:80"); err != socks5.ErrReplyConnectionNotAllowed {
+		t.Error(err)
+	}
+}
+
+func TestServer_RequestFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	srv := &server.Server{RequestFilter: &server.RuleSet{}}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.DialContext(ctx, "tcp", echo.Addr().String()); !errors.Is(err, socks5.ErrReplyConnectionNotAllowed) {
+		t.Error(err)
+	}
+
+	srv.RequestFilter = &server.RuleSet{AllowPrivate: true}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestServer_RequestFilter_DialsChecked(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	// the name only resolves using the RuleSet's lookuper, so the server must dial the checked address
+	rs := &server.RuleSet{
+		Rules:        []server.Rule{{Action: server.RuleAllow, Destinations: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}},
+		HostLookuper: staticLookuper{"echo.test": {"127.0.0.1"}},
+	}
+	listen := startServer(t, ctx, &server.Server{RequestFilter: rs})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := strings.Cut(echo.Addr().String(), ":")
+	conn, err := cli.DialContext(ctx, "tcp", "echo.test:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+// countingFilter denies all requests and counts them.
+type countingFilter struct{ n atomic.Int32 }
+
+func (cf *countingFilter) FilterRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) error {
+	cf.n.Add(1)
+	return socks5.ErrReplyConnectionNotAllowed
+}
+
+func TestServer_RequestFilter_AssociateDenyCached(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	cf := &countingFilter{}
+	listen := startServer(t, ctx, &server.Server{RequestFilter: cf})
+	defer listen.Close()
+
+	_, relay := rawAssociate(t, listen.Addr().String())
+	pc := sendUDPFrom(t, "127.0.0.1:0", relay, echo.LocalAddr(), "a")
+	ua, err := net.ResolveUDPAddr("udp", relay.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := socks5.AddrFromString(echo.LocalAddr().String())
+	b, _ := (&socks5.UDPPacket{Addr: target, Body: []byte("b")}).MarshalBinary()
+	for range 3 {
+		if _, err = pc.WriteTo(b, ua); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if gotUDP(pc) {
+		t.Error("denied target relayed")
+	}
+	if n := cf.n.Load(); n != 1 {
+		t.Error(n)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/linkdata/socks5"
@@ -13,28 +15,91 @@ import (
 // Server is a SOCKS5 proxy server.
 type Server struct {
 	// List of authentication providers. If nil, uses NoAuthAuthenticator.
-	// Order matters; they are tried in the given order.
+	// Order matters; they are tried in the given order, except that private
+	// methods offered by the client (like socks5.AuthHMAC) are tried first.
 	Authenticators []Authenticator
 
 	// DialerSelector is called to get the ContextDialer to use for an outgoing connection.
 	// If nil, socks5.DefaultDialer will be used, which if not changed is a net.Dialer.
 	DialerSelector
 
+	// RequestFilter, if not nil, is called to allow or deny requests. See RuleSet for a rule-based implementation.
+	RequestFilter RequestFilter
+
+	// Accounter, if not nil, receives traffic accounting records for sessions.
+	Accounter          Accounter
+	AccountingInterval time.Duration // If nonzero, Accounter also receives interim records at this interval
+
+	MaxSessions          int // If nonzero, limits the number of concurrent sessions
+	MaxSessionsPerUser   int // If nonzero, limits the number of concurrent sessions per username, or per source IP address for anonymous sessions
+	MaxSessionsPerSource int // If nonzero, limits the number of concurrent sessions per source IP address
+	MaxUDPTargets        int // If nonzero, limits the number of targets per ASSOCIATE session
+
+	// AllowUDPSourceMismatch, if true, accepts ASSOCIATE datagrams from any source address, as needed
+	// for clients behind NAT. Otherwise they must come from the IP address of the TCP connection,
+	// and from the address and port given in the ASSOCIATE request if those are not zero.
+	AllowUDPSourceMismatch bool
+
+	// UDPNAT selects how ASSOCIATE sessions map and filter outbound datagrams. The default, UDPNATSymmetric,
+	// uses a socket per target. The other modes use a socket per dialer selected by the DialerSelector,
+	// falling back to UDPNATSymmetric for the targets of a dialer that is neither a socks5.PacketListener nor a *net.Dialer.
+	UDPNAT UDPNAT
+
+	// RateLimiter, if not nil, provides bandwidth limits per user and source address.
+	RateLimiter RateLimiter
+
+	// Metrics, if not nil, receives counters, gauges and histograms. See PrometheusMetrics.
+	Metrics Metrics
+
+	// EventHandler, if not nil, receives session lifecycle events.
+	EventHandler EventHandler
+
 	Logger socks5.Logger // If not nil, use this Logger (compatible with log/slog)
 	Debug  bool          // If true, output debug logging using Logger.Info
 
-	mu        sync.Mutex // protects following
-	serving   int
-	listeners map[string]*listener
-	started   time.Time // time when Server.Serve() was called
+	DialTimeout      time.Duration // If nonzero, limits the time to dial outgoing connections, otherwise DefaultDialTimeout is used
+	HandshakeTimeout time.Duration // If nonzero, limits the time for the client greeting, authentication and request
+	IdleTimeout      time.Duration // If nonzero, relays with no traffic in either direction for this long are closed
+	SessionTimeout   time.Duration // If nonzero, limits the total lifetime of a session
+
+	// AllowSOCKS4, if true, also serves SOCKS4 and SOCKS4a clients. Since SOCKS4 has no authentication,
+	// they are refused unless the Authenticators accept socks5.AuthMethodNone, and are anonymous.
+	AllowSOCKS4 bool
+
+	// AllowHTTP, if true, also serves HTTP proxy clients using the CONNECT method or absolute URIs.
+	// Basic authentication credentials are checked by the Authenticators as socks5.AuthUserPass.
+	AllowHTTP bool
+
+	mu          sync.Mutex // protects following
+	serving     int
+	listeners   map[string]*listener
+	started     time.Time                 // time when Server.Serve() was called
+	acceptors   map[net.Listener]struct{} // listeners passed to Serve()
+	sessions    map[*session]struct{}     // active sessions
+	rateBuckets map[string]*rateBuckets   // shared rate limits
+	quotas      map[string]int            // session counts for session limits
+	shutdown    bool                      // true once Shutdown() has been called
+	sessionID   atomic.Uint64             // last session ID handed out
 }
 
 var (
 	// UDPTimeout is how long before we stop listening on UDP sockets opened in support of an ASSOCIATE command.
 	UDPTimeout = time.Second * 10
 
+	// UDPReassemblyTimeout is how long to wait for the remaining fragments of a fragmented UDP datagram.
+	UDPReassemblyTimeout = time.Second * 5
+
 	// ListenerTimeout is how long to keep a BIND socket open after the client is done with it.
 	ListenerTimeout = time.Second * 1
+
+	// DefaultDialTimeout is the dial timeout used if Server.DialTimeout is zero.
+	DefaultDialTimeout = time.Second * 5
+
+	// HTTPMaxHeaderBytes limits the size of the request line and headers of HTTP proxy requests.
+	HTTPMaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+	// ShutdownPollInterval is how often Shutdown checks if all sessions have finished.
+	ShutdownPollInterval = time.Millisecond * 100
 )
 
 func listenKey(client net.Conn, address string) (key string) {
@@ -51,7 +116,7 @@ func listenKey(client net.Conn, address string) (key string) {
 	return
 }
 
-func (s *Server) getListener(ctx context.Context, client net.Conn, bindaddress string) (nl net.Listener, err error) {
+func (s *Server) getListener(ctx context.Context, client net.Conn, bindaddress string) (nl *listenerproxy, err error) {
 	err = net.ErrClosed
 	if s.Serving() > 0 {
 		err = nil
@@ -73,12 +138,9 @@ func (s *Server) getListener(ctx context.Context, client net.Conn, bindaddress s
 					newlistener, err = lc.Listen(ctx, "tcp", bindaddress)
 				}
 				if err == nil {
-					l = &listener{
-						srv:      s,
-						key:      key,
-						Listener: newlistener,
-					}
+					l = newListener(s, key, newlistener)
 					s.listeners[key] = l
+					s.addGauge(MetricBindListenersActive, 1)
 					_ = s.Debug && s.LogDebug("listener open", "key", key)
 				}
 			}
@@ -118,17 +180,23 @@ func (s *Server) maybeLogError(err error, msg string, keyvaluepairs ...any) {
 	}
 }
 
-func (s *Server) close() {
+func (s *Server) closeListenersLocked() {
+	for _, l := range s.listeners {
+		_ = s.Debug && s.LogDebug("Server.close(): listener stop", "address", l.key)
+		l.refs.Store(0)
+		l.stop()
+		s.addGauge(MetricBindListenersActive, -1)
+	}
+	clear(s.listeners)
+}
+
+func (s *Server) close(l net.Listener) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.serving--
-	if s.serving < 1 {
-		for _, l := range s.listeners {
-			_ = s.Debug && s.LogDebug("Server.close(): listener stop", "address", l.key)
-			l.refs.Store(0)
-			_ = l.Listener.Close()
-		}
-		clear(s.listeners)
+	delete(s.acceptors, l)
+	if s.serving < 1 && !s.shutdown {
+		s.closeListenersLocked()
 	}
 }
 
@@ -141,14 +209,24 @@ func (s *Server) Serving() (n int) {
 }
 
 // Serve accepts and handles incoming connections on the given listener.
+//
+// After Shutdown has been called, Serve returns socks5.ErrServerClosed.
 func (s *Server) Serve(ctx context.Context, l net.Listener) (err error) {
-	defer s.close()
 	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return socks5.ErrServerClosed
+	}
+	defer s.close(l)
 	s.serving++
 	if s.listeners == nil {
 		s.listeners = make(map[string]*listener)
 		s.started = time.Now()
 	}
+	if s.acceptors == nil {
+		s.acceptors = make(map[net.Listener]struct{})
+	}
+	s.acceptors[l] = struct{}{}
 	s.mu.Unlock()
 	errchan := make(chan error, 1)
 	s.LogInfo("listening", "address", l.Addr())
@@ -157,6 +235,9 @@ func (s *Server) Serve(ctx context.Context, l net.Listener) (err error) {
 	select {
 	case <-ctx.Done():
 	case err = <-errchan:
+		if s.isShutdown() {
+			err = socks5.ErrServerClosed
+		}
 	}
 	return
 }
@@ -169,7 +250,8 @@ func (s *Server) listenerCleanup() {
 		if refs := l.refs.Load(); refs < 1 {
 			if died := l.died.Load(); died < deadline {
 				delete(s.listeners, k)
-				_ = l.Listener.Close()
+				l.stop()
+				s.addGauge(MetricBindListenersActive, -1)
 				_ = s.Debug && s.LogDebug("listener closed", "key", k, "refs", refs, "died", died)
 			}
 		}
@@ -195,6 +277,7 @@ func (s *Server) listen(ctx context.Context, errchan chan<- error, l net.Listene
 	for err == nil {
 		var clientConn net.Conn
 		if clientConn, err = l.Accept(); err == nil {
+			s.addCounter(MetricConnectionsAccepted, 1)
 			go s.startConn(ctx, clientConn)
 		}
 	}
@@ -203,22 +286,27 @@ func (s *Server) listen(ctx context.Context, errchan chan<- error, l net.Listene
 
 func (s *Server) startConn(ctx context.Context, clientConn net.Conn) {
 	defer clientConn.Close()
-	_ = s.Debug && s.LogDebug("session start", "session", clientConn.RemoteAddr())
-	conn := &session{conn: clientConn, Server: s}
-	err := conn.serve(ctx)
-	_ = s.Debug && s.LogDebug("session stop", "session", clientConn.RemoteAddr(), "err", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sess := &session{conn: clientConn, rawconn: clientConn, Server: s, id: s.sessionID.Add(1), cancel: cancel}
+	if s.addSession(sess) {
+		defer s.removeSession(sess)
+		_ = s.Debug && s.LogDebug("session start", "session", clientConn.RemoteAddr())
+		err := sess.serve(ctx)
+		_ = s.Debug && s.LogDebug("session stop", "session", clientConn.RemoteAddr(), "err", err)
+		sess.emit(Event{Type: EventClose, Err: err})
+	}
 }
 
+// readClientGreeting reads the authentication methods offered in the client greeting.
+// The version byte must already have been read.
 func readClientGreeting(r io.Reader) (authMethods []socks5.AuthMethod, err error) {
-	var hdr [2]byte
-	if _, err = io.ReadFull(r, hdr[:]); err == nil {
-		if err = socks5.MustEqual(hdr[0], socks5.Socks5Version, socks5.ErrVersion); err == nil {
-			count := int(hdr[1])
-			methods := make([]byte, count)
-			if _, err = io.ReadFull(r, methods); err == nil {
-				for _, m := range methods {
-					authMethods = append(authMethods, socks5.AuthMethod(m))
-				}
+	var count [1]byte
+	if _, err = io.ReadFull(r, count[:]); err == nil {
+		methods := make([]byte, count[0])
+		if _, err = io.ReadFull(r, methods); err == nil {
+			for _, m := range methods {
+				authMethods = append(authMethods, socks5.AuthMethod(m))
 			}
 		}
 	}
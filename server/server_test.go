@@ -5,6 +5,7 @@ package server_test
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"net"
 	"testing"
@@ -128,3 +129,128 @@ func TestServer_Serve_TwoListeners(t *testing.T) {
 		t.Error(ctx.Err())
 	}
 }
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	srv := &server.Server{Logger: slog.Default(), Debug: true}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(ctx, listen) }()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if n := srv.Sessions(); n != 1 {
+		t.Error("sessions", n)
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Millisecond*50)
+	defer shutdownCancel()
+	if err = srv.Shutdown(shutdownCtx); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+
+	select {
+	case err = <-serveErr:
+		if err != socks5.ErrServerClosed {
+			t.Error(err)
+		}
+	case <-ctx.Done():
+		t.Fatal(ctx.Err())
+	}
+
+	// the forcibly closed session must terminate the relay
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected error")
+	}
+	for ctx.Err() == nil && srv.Sessions() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err = srv.Serve(ctx, listen); err != socks5.ErrServerClosed {
+		t.Error(err)
+	}
+}
+
+func TestServer_Shutdown_Drained(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+
+	srv := &server.Server{Logger: slog.Default(), Debug: true}
+	go srv.Serve(ctx, listen)
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- srv.Shutdown(ctx) }()
+
+	// the session keeps working while the server drains
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Error(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Error(err)
+	}
+	_ = conn.Close()
+
+	if err = <-shutdownDone; err != nil {
+		t.Error(err)
+	}
+	if n := srv.Sessions(); n != 0 {
+		t.Error("sessions", n)
+	}
+}
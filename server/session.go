@@ -2,86 +2,342 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"io"
 	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/linkdata/socks5"
 )
 
+// protocol is the protocol a client session uses.
+type protocol byte
+
+const (
+	protoSOCKS5      protocol = iota // SOCKS5
+	protoSOCKS4                      // SOCKS4 or SOCKS4a
+	protoHTTPConnect                 // HTTP CONNECT method
+	protoHTTPForward                 // HTTP request with an absolute URI
+)
+
 type session struct {
-	*Server           // server we belong to
-	conn     net.Conn // client session connection
-	username string   // username, empty string if anonymous (AuthMethodNone)
+	*Server                        // server we belong to
+	id        uint64               // session ID, unique per Server
+	cancel    context.CancelFunc   // cancels the session context
+	conn      net.Conn             // client session connection, may be replaced by a ContextAuthenticator
+	rawconn   net.Conn             // client connection as accepted
+	identity  *Identity            // authenticated identity, nil before authentication
+	username  string               // username, empty string if anonymous (AuthMethodNone)
+	cmd       socks5.CommandType   // requested command
+	target    string               // address from the client request
+	started   time.Time            // when the request was received
+	active    atomic.Int64         // time of last relayed traffic, in Unix nanoseconds
+	bytesUp   atomic.Int64         // bytes relayed from client to targets
+	bytesDown atomic.Int64         // bytes relayed from targets to client
+	rates     []*rateBuckets       // rate limits that apply
+	udpDenied map[string]time.Time // ASSOCIATE targets denied by the RequestFilter, used only by serveUDP
+	replied   bool                 // true once a reply has been sent, after which failures are not reported to the client
+	proto     protocol             // protocol the client speaks
+}
+
+// sessionKey is the context key for the *session being authenticated.
+type sessionKey struct{}
+
+// touch records that traffic was relayed.
+func (sess *session) touch() {
+	sess.active.Store(time.Now().UnixNano())
+}
+
+// idle returns the time since traffic was last relayed.
+func (sess *session) idle() time.Duration {
+	return time.Since(time.Unix(0, sess.active.Load()))
+}
+
+// selectDialer returns the ContextDialer to use for network and addr.
+func (sess *session) selectDialer(network, addr string) (dialer socks5.ContextDialer, err error) {
+	if ids, ok := sess.Server.DialerSelector.(IdentityDialerSelector); ok {
+		dialer, err = ids.SelectDialerIdentity(sess.identity, network, addr)
+	} else if sess.Server.DialerSelector != nil {
+		dialer, err = sess.Server.DialerSelector.SelectDialer(sess.username, network, addr)
+	}
+	if err == nil && dialer == nil {
+		dialer = socks5.DefaultDialer
+	}
+	return
 }
 
 func (sess *session) DialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	return sess.dialChecked(ctx, network, addr, nil)
+}
+
+// dialChecked connects to addr. If addrs is not empty, they are the addresses addr was resolved to
+// by the RequestFilter, and they are tried in order instead of dialing addr.
+func (sess *session) dialChecked(ctx context.Context, network, addr string, addrs []string) (conn net.Conn, err error) {
 	var dialer socks5.ContextDialer
-	if sess.Server.DialerSelector != nil {
-		dialer, err = sess.Server.DialerSelector.SelectDialer(sess.username, network, addr)
+	if dialer, err = sess.selectDialer(network, addr); err == nil {
+		ctx, cancel := context.WithTimeout(ctx, sess.dialTimeout(network, addr))
+		defer cancel()
+		sess.emit(Event{Type: EventDialStart, Network: network, Address: addr})
+		started := time.Now()
+		if len(addrs) == 0 {
+			addrs = []string{addr}
+		}
+		var errs []error
+		for _, a := range addrs {
+			if conn, err = dialer.DialContext(ctx, network, a); err == nil {
+				break
+			}
+			errs = append(errs, err)
+		}
+		if conn == nil {
+			err = socks5.JoinErrs(errs...)
+		}
+		sess.observeDial(network, started, err)
+		sess.emit(Event{Type: EventDialDone, Network: network, Address: addr, Err: err})
 	}
-	if err == nil {
-		if dialer == nil {
-			dialer = socks5.DefaultDialer
+	return
+}
+
+// filter returns nil if the RequestFilter allows the request. If the filter is a ResolvingRequestFilter,
+// it also returns the checked addresses to connect to.
+func (sess *session) filter(ctx context.Context, cmd socks5.CommandType, addr string) (addrs []string, err error) {
+	if sess.RequestFilter != nil {
+		source := sess.conn.RemoteAddr().String()
+		if rrf, ok := sess.RequestFilter.(ResolvingRequestFilter); ok {
+			var ips []netip.Addr
+			if ips, err = rrf.ResolveRequest(ctx, sess.username, source, cmd, addr); err == nil && len(ips) > 0 {
+				var port string
+				if _, port, err = net.SplitHostPort(addr); err == nil {
+					for _, ip := range ips {
+						addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+					}
+				}
+			}
+		} else {
+			err = sess.RequestFilter.FilterRequest(ctx, sess.username, source, cmd, addr)
+		}
+		if err != nil {
+			_ = sess.Debug && sess.LogDebug("request denied", "session", sess.conn.RemoteAddr(), "command", cmd, "address", addr, "error", err)
+		}
+	}
+	return
+}
+
+func (sess *session) dialTimeout(network, addr string) (timeout time.Duration) {
+	if dts, ok := sess.Server.DialerSelector.(DialTimeoutSelector); ok {
+		timeout = dts.SelectDialTimeout(sess.username, network, addr)
+	}
+	if timeout <= 0 {
+		if timeout = sess.DialTimeout; timeout <= 0 {
+			timeout = DefaultDialTimeout
 		}
-		conn, err = dialer.DialContext(ctx, network, addr)
 	}
 	return
 }
 
 func (sess *session) serve(ctx context.Context) (err error) {
-	if sess.username, err = sess.authenticate(); err == nil {
-		err = sess.handleRequest(ctx)
+	if sess.SessionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sess.SessionTimeout)
+		defer cancel()
+		tmr := time.AfterFunc(sess.SessionTimeout, func() { _ = sess.rawconn.Close() })
+		defer tmr.Stop()
+	}
+	if sess.HandshakeTimeout > 0 {
+		_ = sess.conn.SetDeadline(time.Now().Add(sess.HandshakeTimeout))
+	}
+	if tc, ok := sess.conn.(*tls.Conn); ok {
+		err = tc.HandshakeContext(ctx)
+	}
+	if err == nil {
+		var version [1]byte
+		if _, err = io.ReadFull(sess.conn, version[:]); err == nil {
+			if version[0] == socks5.Socks4Version && sess.AllowSOCKS4 {
+				err = sess.serveSOCKS4(ctx)
+			} else if version[0] >= 'A' && version[0] <= 'Z' && sess.AllowHTTP {
+				err = sess.serveHTTP(ctx, version[0])
+			} else if err = socks5.MustEqual(version[0], socks5.Socks5Version, socks5.ErrVersion); err == nil {
+				if sess.identity, err = sess.authenticate(ctx); err == nil {
+					sess.username = sess.identity.Username
+					err = sess.handleRequest(ctx)
+				}
+			}
+		}
 	}
 	return
 }
 
-func (sess *session) authenticate() (username string, err error) {
+func (sess *session) authenticate(ctx context.Context) (id *Identity, err error) {
 	var clientAuthMethods []socks5.AuthMethod
 	if clientAuthMethods, err = readClientGreeting(sess.conn); err == nil {
-		err = socks5.ErrNoAcceptableAuthMethods
-		authenticators := sess.Authenticators
-		if authenticators == nil {
-			authenticators = []Authenticator{NoAuthAuthenticator{}}
+		sess.emit(Event{Type: EventGreeting, AuthMethods: clientAuthMethods})
+		if id, err = sess.authenticateMethods(ctx, sess.conn, clientAuthMethods); err != socks5.ErrNoAcceptableAuthMethods {
+			return
 		}
+	}
+	_, _ = sess.conn.Write([]byte{socks5.Socks5Version, byte(socks5.AuthNoAcceptable)})
+	return
+}
+
+// authenticateMethods authenticates the client over conn using the first of the Authenticators
+// supporting any of methods, and returns socks5.ErrNoAcceptableAuthMethods if there is none.
+func (sess *session) authenticateMethods(ctx context.Context, conn net.Conn, methods []socks5.AuthMethod) (id *Identity, err error) {
+	authenticators := sess.Authenticators
+	if authenticators == nil {
+		authenticators = []Authenticator{NoAuthAuthenticator{}}
+	}
+	// private methods the client offers are preferred, since they don't send passwords in clear text
+	for _, private := range []bool{true, false} {
 		for _, auther := range authenticators {
-			for _, clientAuth := range clientAuthMethods {
-				if s, e := auther.Socks5Authenticate(sess.conn, clientAuth, sess.conn.RemoteAddr().String()); e != socks5.ErrAuthMethodNotSupported {
-					username = s
-					err = e
-					return
+			for _, am := range methods {
+				if isPrivateAuthMethod(am) == private {
+					if id, err = sess.authenticateWith(ctx, conn, auther, am); err != socks5.ErrAuthMethodNotSupported {
+						ev := Event{Type: EventAuthResult, AuthMethod: am, Identity: id, Err: err}
+						if id != nil {
+							ev.Username = id.Username
+						}
+						sess.countAuth(am, err)
+						sess.emit(ev)
+						return
+					}
 				}
 			}
 		}
 	}
-	_, _ = sess.conn.Write([]byte{socks5.Socks5Version, byte(socks5.AuthNoAcceptable)})
+	id, err = nil, socks5.ErrNoAcceptableAuthMethods
+	sess.countAuth(socks5.AuthNoAcceptable, err)
+	sess.emit(Event{Type: EventAuthChosen, AuthMethod: socks5.AuthNoAcceptable})
 	return
 }
 
+// authenticateWith runs auther for am over conn. EventAuthChosen is emitted when the authenticator
+// sends the method selection message, before it goes on to authenticate the client.
+func (sess *session) authenticateWith(ctx context.Context, conn net.Conn, auther Authenticator, am socks5.AuthMethod) (id *Identity, err error) {
+	cc := &chosenConn{Conn: conn, chosen: func() { sess.emit(Event{Type: EventAuthChosen, AuthMethod: am}) }}
+	if ca, ok := auther.(ContextAuthenticator); ok {
+		ctx = context.WithValue(ctx, sessionKey{}, sess)
+		info := ConnInfo{
+			Conn:       cc,
+			LocalAddr:  sess.conn.LocalAddr(),
+			RemoteAddr: sess.conn.RemoteAddr(),
+		}
+		if tc, ok := sess.rawconn.(*tls.Conn); ok {
+			state := tc.ConnectionState()
+			info.TLS = &state
+		}
+		if id, err = ca.Socks5AuthenticateContext(ctx, &info, am); err == nil && info.Conn != nil && info.Conn != net.Conn(cc) && conn == sess.conn {
+			sess.conn = info.Conn
+		}
+	} else {
+		id, err = usernameIdentity(auther.Socks5Authenticate(cc, am, sess.conn.RemoteAddr().String()))
+	}
+	if err != socks5.ErrAuthMethodNotSupported {
+		cc.once.Do(cc.chosen)
+	}
+	if err == nil && id == nil {
+		id = &Identity{}
+	}
+	return
+}
+
+// chosenConn calls chosen once, before the first write.
+type chosenConn struct {
+	net.Conn
+	once   sync.Once
+	chosen func()
+}
+
+func (c *chosenConn) Write(b []byte) (int, error) {
+	c.once.Do(c.chosen)
+	return c.Conn.Write(b)
+}
+
+// offlineConn lets the Authenticators check credentials obtained using another protocol.
+// Reads return the SOCKS5 sub-negotiation the credentials were translated to, and writes are discarded.
+type offlineConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *offlineConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *offlineConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
 func (sess *session) handleRequest(ctx context.Context) (err error) {
 	var req *Request
 	if req, err = ReadRequest(sess.conn); err == nil {
-		switch req.Cmd {
-		case socks5.CommandConnect:
-			err = sess.handleCONNECT(ctx, req.Addr.String())
-		case socks5.CommandAssociate:
-			err = sess.handleASSOCIATE(ctx)
-		case socks5.CommandBind:
+		err = sess.serveRequest(ctx, req)
+	}
+	return sess.fail(err)
+}
+
+// serveRequest performs a request from any of the supported protocols.
+func (sess *session) serveRequest(ctx context.Context, req *Request) (err error) {
+	_ = sess.conn.SetDeadline(time.Time{})
+	sess.cmd = req.Cmd
+	sess.target = req.Addr.String()
+	sess.started = time.Now()
+	sess.addCounter(MetricCommands, 1, "command", req.Cmd.String())
+	sess.emit(Event{Type: EventRequest})
+	stopAccounting := sess.startAccounting()
+	defer stopAccounting()
+	stopRateLimits := sess.startRateLimits()
+	defer stopRateLimits()
+	var releaseQuotas func()
+	releaseQuotas, err = sess.acquireQuotas()
+	defer releaseQuotas()
+	switch {
+	case err != nil:
+		_ = sess.Debug && sess.LogDebug("request refused", "session", sess.conn.RemoteAddr(), "error", err)
+	case req.Cmd == socks5.CommandConnect:
+		var addrs []string
+		if addrs, err = sess.filter(ctx, req.Cmd, req.Addr.String()); err == nil {
+			err = sess.handleCONNECT(ctx, req.Addr.String(), addrs)
+		}
+	case req.Cmd == socks5.CommandAssociate && sess.proto == protoSOCKS5:
+		err = sess.handleASSOCIATE(ctx, req.Addr)
+	case req.Cmd == socks5.CommandBind:
+		if _, err = sess.filter(ctx, req.Cmd, req.Addr.String()); err == nil {
 			err = sess.handleBIND(ctx, req.Addr.String())
-		default:
-			err = socks5.ErrReplyCommandNotSupported
 		}
+	default:
+		err = socks5.ErrReplyCommandNotSupported
 	}
-	return sess.fail(err)
+	return
 }
 
-func (sess *session) fail(err error) error {
-	if err != nil {
-		replyCode := socks5.ReplyGeneralFailure
-		if re, ok := err.(socks5.ReplyError); ok {
-			replyCode = re.ReplyCode
+// reply sends a reply to the client.
+func (sess *session) reply(code socks5.ReplyCode, addr socks5.Addr) (err error) {
+	var buf []byte
+	switch sess.proto {
+	case protoSOCKS4:
+		buf = socks4Reply(code, addr)
+	case protoHTTPConnect, protoHTTPForward:
+		buf = httpReply(code, sess.proto == protoHTTPForward)
+	default:
+		buf, err = (&Response{Addr: addr, Reply: code}).MarshalBinary()
+	}
+	if err == nil {
+		sess.replied = true
+		if _, err = sess.conn.Write(buf); err == nil {
+			sess.countReply(code)
+			sess.emit(Event{Type: EventReply, Reply: code, Address: addr.String()})
 		}
-		rsp := Response{Addr: socks5.ZeroAddr, Reply: replyCode}
-		buf, _ := rsp.MarshalBinary()
-		_, _ = sess.conn.Write(buf)
+	}
+	return
+}
+
+// fail sends a failure reply to the client for err, unless a reply has already been sent.
+func (sess *session) fail(err error) error {
+	if err != nil && !sess.replied {
+		_ = sess.reply(replyCode(err), socks5.ZeroAddr)
 	}
 	return err
 }
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown gracefully shuts down the server without interrupting active sessions.
+//
+// It first closes all listeners passed to Serve, causing those calls to return socks5.ErrServerClosed.
+// It then waits for active sessions to finish. If ctx expires before that happens, the remaining
+// sessions are forcibly closed and the context error is returned. BIND listeners are closed when
+// Shutdown returns.
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.shutdown = true
+	for l := range s.acceptors {
+		_ = l.Close()
+	}
+	s.mu.Unlock()
+	_ = s.Debug && s.LogDebug("shutdown", "sessions", s.Sessions())
+
+	tmr := time.NewTicker(ShutdownPollInterval)
+	defer tmr.Stop()
+	for err == nil && s.Sessions() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-tmr.C:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.sessions {
+		_ = s.Debug && s.LogDebug("shutdown: closing session", "session", sess.rawconn.RemoteAddr())
+		_ = sess.rawconn.Close()
+		sess.cancel()
+	}
+	s.closeListenersLocked()
+	return
+}
+
+// Sessions returns the number of active client sessions.
+func (s *Server) Sessions() (n int) {
+	s.mu.Lock()
+	n = len(s.sessions)
+	s.mu.Unlock()
+	return
+}
+
+func (s *Server) isShutdown() (yes bool) {
+	s.mu.Lock()
+	yes = s.shutdown
+	s.mu.Unlock()
+	return
+}
+
+func (s *Server) addSession(sess *session) (ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.shutdown {
+		if s.sessions == nil {
+			s.sessions = make(map[*session]struct{})
+		}
+		s.sessions[sess] = struct{}{}
+		s.addGauge(MetricSessionsActive, 1)
+		ok = true
+	}
+	return
+}
+
+func (s *Server) removeSession(sess *session) {
+	s.mu.Lock()
+	if _, ok := s.sessions[sess]; ok {
+		delete(s.sessions, sess)
+		s.addGauge(MetricSessionsActive, -1)
+	}
+	s.mu.Unlock()
+}
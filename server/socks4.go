@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+
+	"github.com/linkdata/socks5"
+)
+
+// socks4MaxField is the maximum length of the USERID and hostname fields in SOCKS4 requests.
+const socks4MaxField = 255
+
+// readSocks4Request reads a SOCKS4 or SOCKS4a request. The version byte must already have been read.
+func readSocks4Request(r io.Reader) (req *Request, userid string, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(r, hdr[:]); err == nil {
+		port := binary.BigEndian.Uint16(hdr[1:3])
+		ip := netip.AddrFrom4([4]byte(hdr[3:7]))
+		if userid, err = readSocks4String(r); err == nil {
+			host := ip.String()
+			if hdr[3] == 0 && hdr[4] == 0 && hdr[5] == 0 && hdr[6] != 0 {
+				// SOCKS4a, the hostname follows the USERID
+				host, err = readSocks4String(r)
+			}
+			if err == nil {
+				req = &Request{
+					Addr: socks5.AddrFromHostPort(host, port),
+					Cmd:  socks5.CommandType(hdr[0]),
+				}
+			}
+		}
+	}
+	return
+}
+
+// readSocks4String reads a NUL terminated string.
+func readSocks4String(r io.Reader) (s string, err error) {
+	var b []byte
+	var c [1]byte
+	for err == nil {
+		if _, err = io.ReadFull(r, c[:]); err == nil {
+			if c[0] == 0 {
+				break
+			}
+			if len(b) >= socks4MaxField {
+				err = socks5.ErrInvalidSocks4Request
+			}
+			b = append(b, c[0])
+		}
+	}
+	s = string(b)
+	return
+}
+
+// socks4Reply returns a SOCKS4 reply packet. Addresses that are not IPv4 are sent as 0.0.0.0.
+func socks4Reply(code socks5.ReplyCode, addr socks5.Addr) (pkt []byte) {
+	cd := socks5.Socks4Rejected
+	if code == socks5.ReplySuccess {
+		cd = socks5.Socks4Granted
+	}
+	pkt = append(pkt, socks5.Socks4ReplyVersion, byte(cd))
+	pkt = binary.BigEndian.AppendUint16(pkt, addr.Port)
+	ip4 := netip.IPv4Unspecified()
+	if ip, err := netip.ParseAddr(addr.Addr); err == nil && ip.Unmap().Is4() {
+		ip4 = ip.Unmap()
+	}
+	return append(pkt, ip4.AsSlice()...)
+}
+
+// socks4BindAddr returns the address to listen on for a SOCKS4 BIND request.
+//
+// SOCKS4 clients send the address of the application server rather than an address to listen on,
+// so unless addr is unspecified or the address the client connected to, we listen on a random port.
+func (sess *session) socks4BindAddr(addr socks5.Addr) string {
+	if ip, err := netip.ParseAddr(addr.Addr); err == nil && !ip.IsUnspecified() {
+		if host, _, err := net.SplitHostPort(sess.conn.LocalAddr().String()); err == nil && host != ip.String() {
+			return net.JoinHostPort(host, "0")
+		}
+	}
+	return addr.String()
+}
+
+// socks4Identity returns a copy of id with the "socks4-userid" attribute set to userid.
+func socks4Identity(id *Identity, userid string) *Identity {
+	cp := *id
+	cp.Attributes = maps.Clone(id.Attributes)
+	if cp.Attributes == nil {
+		cp.Attributes = make(map[string]string)
+	}
+	cp.Attributes["socks4-userid"] = userid
+	return &cp
+}
+
+// serveSOCKS4 handles a SOCKS4 or SOCKS4a session. The version byte must already have been read.
+//
+// SOCKS4 has no authentication, so the session is only served if the Authenticators accept
+// socks5.AuthMethodNone. The session stays anonymous, and the unverified USERID is set as the
+// "socks4-userid" attribute of its Identity.
+func (sess *session) serveSOCKS4(ctx context.Context) (err error) {
+	sess.proto = protoSOCKS4
+	var req *Request
+	var userid string
+	if req, userid, err = readSocks4Request(sess.conn); err == nil {
+		_ = sess.Debug && sess.LogDebug("SOCKS4", "session", sess.conn.RemoteAddr(), "userid", userid)
+		offline := &offlineConn{Conn: sess.conn, r: bytes.NewReader(nil)}
+		if sess.identity, err = sess.authenticateMethods(ctx, offline, []socks5.AuthMethod{socks5.AuthMethodNone}); err == nil {
+			sess.identity = socks4Identity(sess.identity, userid)
+			sess.username = sess.identity.Username
+			if req.Cmd == socks5.CommandBind {
+				var addr socks5.Addr
+				if addr, err = socks5.AddrFromString(sess.socks4BindAddr(req.Addr)); err == nil {
+					req.Addr = addr
+				}
+			}
+			if err == nil {
+				err = sess.serveRequest(ctx, req)
+			}
+		}
+	}
+	return sess.fail(err)
+}
@@ -0,0 +1,233 @@
+package server_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/server"
+)
+
+type denyFilter struct{}
+
+func (denyFilter) FilterRequest(ctx context.Context, username, source string, cmd socks5.CommandType, address string) error {
+	return socks5.ErrReplyConnectionNotAllowed
+}
+
+// socks4Request returns a SOCKS4 request, or a SOCKS4a request if host is not an IPv4 address.
+func socks4Request(cmd socks5.CommandType, host string, port uint16, userid string) (b []byte) {
+	b = append(b, socks5.Socks4Version, byte(cmd))
+	b = binary.BigEndian.AppendUint16(b, port)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ip = netip.AddrFrom4([4]byte{0, 0, 0, 1})
+	}
+	b = append(b, ip.AsSlice()...)
+	b = append(b, userid...)
+	b = append(b, 0)
+	if err != nil {
+		b = append(b, host...)
+		b = append(b, 0)
+	}
+	return
+}
+
+func readSocks4Reply(t *testing.T, conn net.Conn) (code socks5.Socks4ReplyCode, addr netip.AddrPort) {
+	t.Helper()
+	var b [8]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != socks5.Socks4ReplyVersion {
+		t.Error(b)
+	}
+	return socks5.Socks4ReplyCode(b[1]), netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), binary.BigEndian.Uint16(b[2:4]))
+}
+
+func socks4Echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Error(string(buf), err)
+	}
+}
+
+func TestServer_SOCKS4_Connect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echoaddr := echo.Addr().(*net.TCPAddr).AddrPort()
+
+	for _, host := range []string{echoaddr.Addr().String(), "localhost"} {
+		acct := &recordingAccounter{}
+		listen := startServer(t, ctx, &server.Server{AllowSOCKS4: true, Accounter: acct})
+		defer listen.Close()
+
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(socks4Request(socks5.CommandConnect, host, echoaddr.Port(), "joe")); err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := readSocks4Reply(t, conn); code != socks5.Socks4Granted {
+			t.Fatal(host, code)
+		}
+		socks4Echo(t, conn)
+		_ = conn.Close()
+
+		rec := acct.final(ctx)
+		if rec.Username != "" || rec.Command != socks5.CommandConnect || rec.BytesUp != 5 {
+			t.Errorf("%+v", rec)
+		}
+	}
+}
+
+func TestServer_SOCKS4_UserID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echoaddr := echo.Addr().(*net.TCPAddr).AddrPort()
+
+	selector := &identityDialerSelector{}
+	listen := startServer(t, ctx, &server.Server{AllowSOCKS4: true, DialerSelector: selector})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(socks4Request(socks5.CommandConnect, echoaddr.Addr().String(), echoaddr.Port(), "joe")); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := readSocks4Reply(t, conn); code != socks5.Socks4Granted {
+		t.Fatal(code)
+	}
+	selector.mu.Lock()
+	defer selector.mu.Unlock()
+	if len(selector.ids) != 1 || selector.ids[0].Username != "" || selector.ids[0].Attributes["socks4-userid"] != "joe" {
+		t.Errorf("%+v", selector.ids)
+	}
+}
+
+func TestServer_SOCKS4_Bind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{AllowSOCKS4: true})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(socks4Request(socks5.CommandBind, "192.0.2.1", 21, "")); err != nil {
+		t.Fatal(err)
+	}
+	code, addr := readSocks4Reply(t, conn)
+	if code != socks5.Socks4Granted || addr.Port() == 0 {
+		t.Fatal(code, addr)
+	}
+
+	remote, err := net.Dial("tcp", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), addr.Port()).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if code, addr = readSocks4Reply(t, conn); code != socks5.Socks4Granted || addr.Port() != remote.LocalAddr().(*net.TCPAddr).AddrPort().Port() {
+		t.Error(code, addr)
+	}
+	go func() { _, _ = io.Copy(remote, remote) }()
+	socks4Echo(t, conn)
+}
+
+func TestServer_SOCKS4_Rejected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{AllowSOCKS4: true, RequestFilter: denyFilter{}})
+	defer listen.Close()
+
+	for _, req := range [][]byte{
+		socks4Request(socks5.CommandConnect, "127.0.0.1", 1, "joe"),
+		socks4Request(socks5.CommandAssociate, "127.0.0.1", 1, "joe"),
+		socks4Request(socks5.CommandConnect, "127.0.0.1", 1, strings.Repeat("x", 300)),
+	} {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := readSocks4Reply(t, conn); code != socks5.Socks4Rejected {
+			t.Error(code)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestServer_SOCKS4_NotAllowed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(socks4Request(socks5.CommandConnect, "127.0.0.1", 1, "")); err != nil {
+		t.Fatal(err)
+	}
+	mustClose(t, conn, time.Second)
+}
+
+func TestServer_SOCKS4_Authenticators(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	echoaddr := echo.Addr().(*net.TCPAddr).AddrPort()
+
+	for _, tc := range []struct {
+		auths []server.Authenticator
+		want  socks5.Socks4ReplyCode
+	}{
+		{[]server.Authenticator{server.UserPassAuthenticator{Credentials: server.StaticCredentials{"joe": "secret"}}}, socks5.Socks4Rejected},
+		{[]server.Authenticator{&server.NoAuthAuthenticator{}}, socks5.Socks4Granted},
+	} {
+		listen := startServer(t, ctx, &server.Server{AllowSOCKS4: true, Authenticators: tc.auths})
+		defer listen.Close()
+
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(socks4Request(socks5.CommandConnect, "127.0.0.1", echoaddr.Port(), "joe")); err != nil {
+			t.Fatal(err)
+		}
+		if code, _ := readSocks4Reply(t, conn); code != tc.want {
+			t.Error(tc.auths, code)
+		}
+		_ = conn.Close()
+	}
+}
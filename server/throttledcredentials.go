@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAuthFailureDelay    = time.Millisecond * 100 // ThrottledCredentials.BaseDelay if zero
+	DefaultAuthFailureMaxDelay = time.Second * 5        // ThrottledCredentials.MaxDelay if zero
+	DefaultLockoutDuration     = time.Minute * 15       // ThrottledCredentials.LockoutDuration if zero
+)
+
+// ThrottledCredentials is a CredentialsValidator that protects another one against brute-force attacks.
+//
+// Failed attempts are counted per username and per source IP address. Further attempts
+// for the same username or source are delayed, starting at BaseDelay and doubling with each
+// consecutive failure up to MaxDelay. Concurrent attempts are spaced out by the same delay,
+// and attempts that would have to wait longer than MaxDelay fail without consulting Credentials.
+// If MaxFailures is nonzero, a username or source with that many consecutive failures is locked
+// out for LockoutDuration, during which all its attempts fail without consulting Credentials.
+// A successful attempt resets the counts for the username and source.
+//
+// Lockouts are reported to the Metrics (as MetricAuthLockouts) and EventHandler (as EventAuthLockout)
+// of the Server whose session is being authenticated.
+type ThrottledCredentials struct {
+	Credentials     CredentialsValidator
+	BaseDelay       time.Duration // delay after the first failure, if zero DefaultAuthFailureDelay is used
+	MaxDelay        time.Duration // upper bound for delays, if zero DefaultAuthFailureMaxDelay is used
+	MaxFailures     int           // if nonzero, consecutive failures before locking out
+	LockoutDuration time.Duration // how long lockouts last, if zero DefaultLockoutDuration is used
+
+	// OnLockout, if not nil, is called when a username or source is locked out.
+	// The key is "user:" followed by the username, or "source:" followed by the IP address.
+	OnLockout func(key string, until time.Time)
+
+	mu       sync.Mutex // protects following
+	failures map[string]*authFailures
+	pruneAt  int // prune failures when it grows to this size
+}
+
+var _ ContextCredentialsValidator = &ThrottledCredentials{}
+
+type authFailures struct {
+	count       int       // consecutive failures
+	last        time.Time // time of last failure
+	next        time.Time // earliest start of the next attempt, reserved by pending attempts
+	lockedUntil time.Time
+}
+
+func (tc *ThrottledCredentials) baseDelay() (d time.Duration) {
+	if d = tc.BaseDelay; d <= 0 {
+		d = DefaultAuthFailureDelay
+	}
+	return
+}
+
+func (tc *ThrottledCredentials) maxDelay() (d time.Duration) {
+	if d = tc.MaxDelay; d <= 0 {
+		d = DefaultAuthFailureMaxDelay
+	}
+	return
+}
+
+func (tc *ThrottledCredentials) lockoutDuration() (d time.Duration) {
+	if d = tc.LockoutDuration; d <= 0 {
+		d = DefaultLockoutDuration
+	}
+	return
+}
+
+// delay returns how long after the last failure the next attempt may be made.
+func (tc *ThrottledCredentials) delay(count int) (d time.Duration) {
+	if count > 0 {
+		d = tc.baseDelay()
+		for i := 1; i < count && d < tc.maxDelay(); i++ {
+			d *= 2
+		}
+		d = min(d, tc.maxDelay())
+	}
+	return
+}
+
+func throttleKeys(username, address string) []string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return []string{"user:" + username, "source:" + host}
+}
+
+// reserve returns how long to wait before attempting, and reserves the delay after that
+// for the attempt. Returns false if locked out or if the wait would exceed the maximum delay.
+func (tc *ThrottledCredentials) reserve(keys []string, now time.Time) (wait time.Duration, ok bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	ok = true
+	for _, key := range keys {
+		if af := tc.failures[key]; af != nil {
+			ok = ok && !now.Before(af.lockedUntil)
+			wait = max(wait, af.last.Add(tc.delay(af.count)).Sub(now), af.next.Sub(now))
+		}
+	}
+	if ok = ok && wait <= tc.maxDelay(); ok {
+		start := now.Add(wait)
+		for _, key := range keys {
+			if af := tc.failures[key]; af != nil {
+				af.next = start.Add(tc.delay(af.count))
+			}
+		}
+	}
+	return
+}
+
+func (tc *ThrottledCredentials) pruneLocked(now time.Time) {
+	if len(tc.failures) >= tc.pruneAt {
+		expiry := max(tc.maxDelay(), tc.lockoutDuration())
+		for key, af := range tc.failures {
+			if now.Sub(af.last) > expiry && !now.Before(af.lockedUntil) && !now.Before(af.next) {
+				delete(tc.failures, key)
+			}
+		}
+		tc.pruneAt = max(1024, len(tc.failures)*2)
+	}
+}
+
+// record updates the failure counts and returns the keys that became locked out.
+func (tc *ThrottledCredentials) record(keys []string, success bool, now time.Time) (locked []string, until time.Time) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if success {
+		for _, key := range keys {
+			delete(tc.failures, key)
+		}
+		return
+	}
+	if tc.failures == nil {
+		tc.failures = make(map[string]*authFailures)
+	}
+	tc.pruneLocked(now)
+	until = now.Add(tc.lockoutDuration())
+	for _, key := range keys {
+		af := tc.failures[key]
+		if af == nil {
+			af = &authFailures{}
+			tc.failures[key] = af
+		}
+		af.count++
+		af.last = now
+		if tc.MaxFailures > 0 && af.count >= tc.MaxFailures && !now.Before(af.lockedUntil) {
+			af.lockedUntil = until
+			af.count = 0
+			locked = append(locked, key)
+		}
+	}
+	return
+}
+
+func (tc *ThrottledCredentials) ValidateCredentials(username, password, address string) bool {
+	return tc.ValidateCredentialsContext(context.Background(), username, password, address)
+}
+
+// ValidateCredentialsContext is like ValidateCredentials, but fails if ctx is done while waiting.
+func (tc *ThrottledCredentials) ValidateCredentialsContext(ctx context.Context, username, password, address string) (ok bool) {
+	keys := throttleKeys(username, address)
+	var wait time.Duration
+	if wait, ok = tc.reserve(keys, time.Now()); ok {
+		if wait > 0 {
+			tmr := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				ok = false
+			case <-tmr.C:
+			}
+			tmr.Stop()
+		}
+		if ok {
+			ok = validateCredentials(ctx, tc.Credentials, username, password, address)
+			locked, until := tc.record(keys, ok, time.Now())
+			sess, _ := ctx.Value(sessionKey{}).(*session)
+			for _, key := range locked {
+				if sess != nil {
+					kind, _, _ := strings.Cut(key, ":")
+					sess.addCounter(MetricAuthLockouts, 1, "kind", kind)
+					sess.emit(Event{Type: EventAuthLockout, Address: key})
+				}
+				if tc.OnLockout != nil {
+					tc.OnLockout(key, until)
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,166 @@
+package server_test
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/server"
+)
+
+func timeValidate(tc *server.ThrottledCredentials, username, password, address string) (ok bool, elapsed time.Duration) {
+	started := time.Now()
+	ok = tc.ValidateCredentials(username, password, address)
+	return ok, time.Since(started)
+}
+
+func TestThrottledCredentials_Delay(t *testing.T) {
+	tc := &server.ThrottledCredentials{
+		Credentials: server.StaticCredentials{"joe": "secret"},
+		BaseDelay:   time.Millisecond * 20,
+		MaxDelay:    time.Millisecond * 40,
+	}
+	// failures from the same address delay further attempts from it, doubling up to MaxDelay
+	for i, want := range []time.Duration{0, 20, 40, 40} {
+		ok, elapsed := timeValidate(tc, "user"+strconv.Itoa(i), "wrong", "1.2.3.4:"+strconv.Itoa(1000+i))
+		if want *= time.Millisecond; ok || elapsed < want-time.Millisecond*5 || elapsed > want+time.Millisecond*30 {
+			t.Error(i, ok, elapsed)
+		}
+	}
+	// failures for a username delay attempts for it from other addresses
+	if ok, elapsed := timeValidate(tc, "joe", "wrong", "5.6.7.8:1000"); ok || elapsed > time.Millisecond*15 {
+		t.Error(ok, elapsed)
+	}
+	if ok, elapsed := timeValidate(tc, "joe", "secret", "9.9.9.9:1000"); !ok || elapsed < time.Millisecond*15 {
+		t.Error(ok, elapsed)
+	}
+	// success resets the username
+	if ok, elapsed := timeValidate(tc, "joe", "secret", "9.9.9.9:1000"); !ok || elapsed > time.Millisecond*15 {
+		t.Error(ok, elapsed)
+	}
+}
+
+func TestThrottledCredentials_Lockout(t *testing.T) {
+	var mu sync.Mutex
+	var locked []string
+	tc := &server.ThrottledCredentials{
+		Credentials:     server.StaticCredentials{"joe": "secret"},
+		BaseDelay:       time.Microsecond,
+		MaxDelay:        time.Microsecond,
+		MaxFailures:     3,
+		LockoutDuration: time.Millisecond * 100,
+		OnLockout: func(key string, until time.Time) {
+			mu.Lock()
+			locked = append(locked, key)
+			mu.Unlock()
+		},
+	}
+	for range 3 {
+		if tc.ValidateCredentials("joe", "wrong", "1.2.3.4:1000") {
+			t.Fatal("wrong password accepted")
+		}
+	}
+	mu.Lock()
+	slices.Sort(locked)
+	if !slices.Equal(locked, []string{"source:1.2.3.4", "user:joe"}) {
+		t.Error(locked)
+	}
+	mu.Unlock()
+	// correct password is rejected while locked out, from any source
+	if tc.ValidateCredentials("joe", "secret", "5.6.7.8:1000") {
+		t.Error("locked out user accepted")
+	}
+	time.Sleep(time.Millisecond * 120)
+	if !tc.ValidateCredentials("joe", "secret", "5.6.7.8:1000") {
+		t.Error("user still locked out")
+	}
+}
+
+func TestThrottledCredentials_Concurrent(t *testing.T) {
+	tc := &server.ThrottledCredentials{
+		Credentials: server.StaticCredentials{"joe": "secret"},
+		BaseDelay:   time.Millisecond * 50,
+		MaxDelay:    time.Millisecond * 100,
+	}
+	tc.ValidateCredentials("joe", "wrong", "1.2.3.4:1000")
+	// concurrent attempts are spaced out, and those that would wait too long are refused
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var elapsed []time.Duration
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, d := timeValidate(tc, "joe", "wrong", "1.2.3.4:1000"); !ok {
+				mu.Lock()
+				elapsed = append(elapsed, d)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	slices.Sort(elapsed)
+	if len(elapsed) != 4 || elapsed[1] > time.Millisecond*20 || elapsed[2] < time.Millisecond*40 || elapsed[3] < time.Millisecond*90 {
+		t.Error(elapsed)
+	}
+}
+
+func TestThrottledCredentials_Context(t *testing.T) {
+	tc := &server.ThrottledCredentials{
+		Credentials: server.StaticCredentials{"joe": "secret"},
+		BaseDelay:   time.Second,
+	}
+	tc.ValidateCredentials("joe", "wrong", "1.2.3.4:1000")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	started := time.Now()
+	if tc.ValidateCredentialsContext(ctx, "joe", "secret", "1.2.3.4:1000") {
+		t.Error("accepted after the context was done")
+	}
+	if elapsed := time.Since(started); elapsed > time.Millisecond*500 {
+		t.Error(elapsed)
+	}
+}
+
+func TestThrottledCredentials_LockoutReported(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	pm := &server.PrometheusMetrics{}
+	reh := &recordingEventHandler{}
+	tc := &server.ThrottledCredentials{
+		Credentials: server.StaticCredentials{"joe": "secret"},
+		BaseDelay:   time.Microsecond,
+		MaxDelay:    time.Microsecond,
+		MaxFailures: 1,
+	}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.UserPassAuthenticator{Credentials: tc}},
+		Metrics:        pm,
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	if err := dialEcho(ctx, t, "socks5h://joe:wrong@"+listen.Addr().String(), "127.0.0.1:1"); err != socks5.ErrAuthFailed {
+		t.Error(err)
+	}
+	var locked []string
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventAuthLockout {
+			locked = append(locked, ev.Address)
+		}
+	}
+	slices.Sort(locked)
+	if !slices.Equal(locked, []string{"source:127.0.0.1", "user:joe"}) {
+		t.Error(locked)
+	}
+	if s := pm.String(); !strings.Contains(s, `socks5_auth_lockouts_total{kind="user"} 1`) || !strings.Contains(s, `socks5_auth_lockouts_total{kind="source"} 1`) {
+		t.Error(s)
+	}
+}
@@ -0,0 +1,202 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func startServer(t *testing.T, ctx context.Context, srv *server.Server) net.Listener {
+	t.Helper()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Logger == nil {
+		srv.Logger = slog.Default()
+		srv.Debug = true
+	}
+	go srv.Serve(ctx, listen)
+	return listen
+}
+
+func mustClose(t *testing.T, conn net.Conn, within time.Duration) {
+	t.Helper()
+	started := time.Now()
+	_ = conn.SetReadDeadline(started.Add(time.Second))
+	var err error
+	for err == nil {
+		_, err = conn.Read(make([]byte, 64))
+	}
+	if err != io.EOF {
+		if ne, ok := err.(net.Error); !ok || ne.Timeout() {
+			t.Error(err)
+		}
+	}
+	if elapsed := time.Since(started); elapsed > within {
+		t.Error("closed after", elapsed)
+	}
+}
+
+func TestServer_HandshakeTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	listen := startServer(t, ctx, &server.Server{HandshakeTimeout: time.Millisecond * 50})
+	defer listen.Close()
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mustClose(t, conn, time.Millisecond*500)
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen := startServer(t, ctx, &server.Server{IdleTimeout: time.Millisecond * 50})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// traffic keeps the relay alive
+	for range 4 {
+		time.Sleep(time.Millisecond * 25)
+		if _, err = conn.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(conn, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the relay is closed without sending a failure reply into the data stream
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 64)); n != 0 || err != io.EOF {
+		t.Error(n, err)
+	}
+}
+
+func TestServer_SessionTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	listen := startServer(t, ctx, &server.Server{SessionTimeout: time.Millisecond * 100})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	started := time.Now()
+	for err == nil && time.Since(started) < time.Second {
+		if _, err = conn.Write([]byte("x")); err == nil {
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = io.ReadFull(conn, make([]byte, 1))
+		}
+	}
+	if err == nil {
+		t.Error("session not closed")
+	}
+}
+
+func TestServer_SessionTimeout_Bind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	srv := &server.Server{SessionTimeout: time.Millisecond * 50}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := cli.ListenContext(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err = l.Accept(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestServer_SessionTimeout_SharedBind(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	srv := &server.Server{SessionTimeout: time.Millisecond * 300}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindaddr := free.Addr().String()
+	_ = free.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first session times out while the second one shares its listener
+	l1, err := cli.ListenContext(ctx, "tcp", bindaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	time.Sleep(time.Millisecond * 150)
+	l2, err := cli.ListenContext(ctx, "tcp", bindaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	time.Sleep(time.Millisecond * 200)
+
+	conn, err := net.Dial("tcp", bindaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if _, err = io.ReadFull(accepted, make([]byte, 1)); err != nil {
+		t.Error(err)
+	}
+}
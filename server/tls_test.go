@@ -0,0 +1,187 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+type testPKI struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) (pki *testPKI) {
+	t.Helper()
+	cakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, catmpl, catmpl, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(cader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(serial int64, tmpl *x509.Certificate) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.SerialNumber = big.NewInt(serial)
+		tmpl.NotBefore = catmpl.NotBefore
+		tmpl.NotAfter = catmpl.NotAfter
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, cakey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pki = &testPKI{pool: x509.NewCertPool()}
+	pki.pool.AddCert(ca)
+	pki.server = issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	pki.client = issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "alice", OrganizationalUnit: []string{"staff"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return
+}
+
+func startTLSServer(t *testing.T, ctx context.Context, srv *server.Server, pki *testPKI) net.Listener {
+	t.Helper()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Logger = slog.Default()
+	srv.Debug = true
+	go srv.Serve(ctx, tls.NewListener(listen, &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+	return listen
+}
+
+func TestServer_TLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	udpecho := startUDPEchoServer(t)
+	defer udpecho.Close()
+
+	pki := newTestPKI(t)
+	reh := &recordingEventHandler{}
+	srv := &server.Server{
+		Authenticators: []server.Authenticator{server.CertificateAuthenticator{}},
+		EventHandler:   reh,
+	}
+	listen := startTLSServer(t, ctx, srv, pki)
+	defer listen.Close()
+
+	sniffer := &sniffingDialer{}
+	cli, err := client.New("socks5h+tls://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.ProxyDialer = sniffer
+	cli.TLSConfig = &tls.Config{
+		RootCAs:      pki.pool,
+		Certificates: []tls.Certificate{pki.client},
+	}
+
+	conn, err := cli.DialContext(ctx, "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "secret" {
+		t.Error(string(buf), err)
+	}
+	_ = conn.Close()
+	if s := sniffer.String(); strings.Contains(s, "secret") || strings.Contains(s, echo.Addr().String()) {
+		t.Errorf("%q", s)
+	}
+
+	var id *server.Identity
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventAuthResult {
+			id = ev.Identity
+		}
+	}
+	if id == nil || id.Username != "alice" || len(id.Groups) != 1 || id.Groups[0] != "staff" || id.Attributes["subject"] == "" {
+		t.Errorf("%+v", id)
+	}
+
+	if conn, err = cli.DialContext(ctx, "udp", udpecho.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Error(string(buf[:n]), err)
+	}
+}
+
+func TestServer_TLS_NoClientCertificate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	pki := newTestPKI(t)
+	srv := &server.Server{Authenticators: []server.Authenticator{server.CertificateAuthenticator{}}}
+	listen := startTLSServer(t, ctx, srv, pki)
+	defer listen.Close()
+
+	cli, err := client.New("socks5hs://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.TLSConfig = &tls.Config{RootCAs: pki.pool}
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err != socks5.ErrNoAcceptableAuthMethods {
+		t.Error(err)
+	}
+
+	cli.TLSConfig = nil
+	if _, err = cli.DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("expected certificate verification error")
+	}
+}
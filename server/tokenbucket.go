@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter where a token is a byte.
+// It allows bursts of up to one second worth of tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second, zero for unlimited
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) setRate(rate int64) {
+	tb.mu.Lock()
+	if tb.rate = float64(rate); tb.last.IsZero() {
+		tb.tokens = tb.rate
+		tb.last = time.Now()
+	}
+	tb.mu.Unlock()
+}
+
+// burst returns the bucket size, or zero if unlimited.
+func (tb *tokenBucket) burst() (n int) {
+	tb.mu.Lock()
+	n = int(tb.rate)
+	tb.mu.Unlock()
+	return
+}
+
+func (tb *tokenBucket) refillLocked() {
+	now := time.Now()
+	tb.tokens = min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// reserve takes n tokens and returns how long to wait until they are available.
+func (tb *tokenBucket) reserve(n int) (wait time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate > 0 {
+		tb.refillLocked()
+		if tb.tokens -= float64(n); tb.tokens < 0 {
+			wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+		}
+	}
+	return
+}
+
+// allow takes n tokens and returns true if they are available. If n is larger than
+// the bucket, it is allowed when the bucket is full, leaving it in debt.
+func (tb *tokenBucket) allow(n int) (ok bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	ok = true
+	if tb.rate > 0 {
+		tb.refillLocked()
+		if ok = tb.tokens >= min(float64(n), tb.rate); ok {
+			tb.tokens -= float64(n)
+		}
+	}
+	return
+}
+
+// refund returns n tokens taken by allow.
+func (tb *tokenBucket) refund(n int) {
+	tb.mu.Lock()
+	if tb.rate > 0 {
+		tb.tokens += float64(n)
+	}
+	tb.mu.Unlock()
+}
+
+// rateBuckets are the shared token buckets for a user or source address.
+type rateBuckets struct {
+	key  string
+	up   tokenBucket
+	down tokenBucket
+	refs int // protected by Server.mu
+}
+
+func (rb *rateBuckets) bucket(up bool) *tokenBucket {
+	if up {
+		return &rb.up
+	}
+	return &rb.down
+}
+
+func (s *Server) acquireRateBuckets(key string, rl RateLimit) (rb *rateBuckets) {
+	if rl.Up > 0 || rl.Down > 0 {
+		s.mu.Lock()
+		if rb = s.rateBuckets[key]; rb == nil {
+			if s.rateBuckets == nil {
+				s.rateBuckets = make(map[string]*rateBuckets)
+			}
+			rb = &rateBuckets{key: key}
+			s.rateBuckets[key] = rb
+		}
+		rb.refs++
+		s.mu.Unlock()
+		rb.up.setRate(rl.Up)
+		rb.down.setRate(rl.Down)
+	}
+	return
+}
+
+func (s *Server) releaseRateBuckets(rb *rateBuckets) {
+	s.mu.Lock()
+	if rb.refs--; rb.refs < 1 {
+		delete(s.rateBuckets, rb.key)
+	}
+	s.mu.Unlock()
+}
+
+// startRateLimits looks up the rate limits for the session. The returned
+// function releases them.
+//
+// The user limit for anonymous sessions is shared per source address rather
+// than by all anonymous clients.
+func (sess *session) startRateLimits() (stop func()) {
+	stop = func() {}
+	if sess.RateLimiter != nil {
+		host, _, _ := net.SplitHostPort(sess.conn.RemoteAddr().String())
+		userKey := "user:" + sess.username
+		if sess.username == "" {
+			userKey = "anonymous:" + host
+		}
+		for _, rb := range []*rateBuckets{
+			sess.acquireRateBuckets(userKey, sess.RateLimiter.UserRateLimit(sess.username)),
+			sess.acquireRateBuckets("source:"+host, sess.RateLimiter.SourceRateLimit(host)),
+		} {
+			if rb != nil {
+				sess.rates = append(sess.rates, rb)
+			}
+		}
+		stop = func() {
+			for _, rb := range sess.rates {
+				sess.releaseRateBuckets(rb)
+			}
+		}
+	}
+	return
+}
+
+// chunkSize returns how many bytes to relay at a time in the given direction.
+func (sess *session) chunkSize(up bool) (n int) {
+	n = relayBufferSize
+	for _, rb := range sess.rates {
+		if burst := rb.bucket(up).burst(); burst > 0 {
+			n = max(1, min(n, burst))
+		}
+	}
+	return
+}
+
+// throttle waits until n bytes may be relayed in the given direction, or ctx is done.
+func (sess *session) throttle(ctx context.Context, n int, up bool) (err error) {
+	var wait time.Duration
+	for _, rb := range sess.rates {
+		wait = max(wait, rb.bucket(up).reserve(n))
+	}
+	if wait > 0 {
+		tmr := time.NewTimer(wait)
+		defer tmr.Stop()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-tmr.C:
+		}
+	}
+	return
+}
+
+// allowPacket returns true if a datagram of n bytes may be relayed in the given direction.
+// Tokens are only taken if all the rate limits allow it.
+func (sess *session) allowPacket(n int, up bool) (ok bool) {
+	ok = true
+	for i, rb := range sess.rates {
+		if ok = rb.bucket(up).allow(n); !ok {
+			for _, taken := range sess.rates[:i] {
+				taken.bucket(up).refund(n)
+			}
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket_AllowLarger(t *testing.T) {
+	var tb tokenBucket
+	tb.setRate(100)
+	if !tb.allow(150) {
+		t.Error("datagram larger than the bucket refused while full")
+	}
+	if tb.allow(1) {
+		t.Error("bucket in debt allowed a datagram")
+	}
+}
+
+func TestSession_AllowPacket_Refund(t *testing.T) {
+	user, source := &rateBuckets{}, &rateBuckets{}
+	user.up.setRate(100)
+	source.up.setRate(100)
+	source.up.allow(100)
+	sess := &session{rates: []*rateBuckets{user, source}}
+	if sess.allowPacket(50, true) {
+		t.Error("allowed above the source limit")
+	}
+	// the user bucket must not have been charged for the refused datagram
+	sess.rates = sess.rates[:1]
+	if !sess.allowPacket(100, true) {
+		t.Error("user bucket was charged")
+	}
+}
+
+func TestSession_Throttle_Context(t *testing.T) {
+	rb := &rateBuckets{}
+	rb.down.setRate(1)
+	sess := &session{rates: []*rateBuckets{rb}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	started := time.Now()
+	if err := sess.throttle(ctx, 100, false); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Error(elapsed)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 func init() {
 	server.UDPTimeout = time.Millisecond * 10
+	server.UDPReassemblyTimeout = time.Millisecond * 100
 }
 
 func TestUDP_Single(t *testing.T) {
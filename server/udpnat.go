@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// UDPNAT selects the NAT behaviour of ASSOCIATE sessions, using the terms of RFC 4787.
+type UDPNAT byte
+
+const (
+	// UDPNATSymmetric uses a separate socket for each target, relaying only
+	// datagrams from that target. This is the default.
+	UDPNATSymmetric UDPNAT = iota
+	// UDPNATEndpointIndependent uses a single socket for all targets, relaying datagrams from any address.
+	UDPNATEndpointIndependent
+	// UDPNATAddressDependent uses a single socket for all targets, relaying
+	// datagrams from IP addresses the client has sent to.
+	UDPNATAddressDependent
+	// UDPNATAddressAndPortDependent uses a single socket for all targets, relaying
+	// datagrams from IP addresses and ports the client has sent to.
+	UDPNATAddressAndPortDependent
+)
+
+var udpNATText = []string{
+	UDPNATSymmetric:               "symmetric",
+	UDPNATEndpointIndependent:     "endpoint-independent",
+	UDPNATAddressDependent:        "address-dependent",
+	UDPNATAddressAndPortDependent: "address-and-port-dependent",
+}
+
+func (n UDPNAT) String() string {
+	if int(n) < len(udpNATText) {
+		return udpNATText[n]
+	}
+	return "udpnat(" + strconv.Itoa(int(n)) + ")"
+}
+
+// errUDPNATUnsupported is returned by udpNAT.send if the target's dialer can't provide a packet connection.
+var errUDPNATUnsupported = errors.New("dialer does not support ListenPacket")
+
+// udpNAT relays datagrams for an ASSOCIATE session using an outbound socket per dialer,
+// as selected by the DialerSelector for each target.
+type udpNAT struct {
+	sess    *session
+	client  net.PacketConn                      // socket the client sends to
+	sockets map[socks5.ContextDialer]*natSocket // outbound sockets by dialer
+	targets map[socks5.Addr]natTarget           // resolved targets
+	wg      sync.WaitGroup                      // running serve goroutines
+}
+
+// natTarget is a target of a udpNAT. The sock is nil if the target's dialer
+// can't provide a packet connection, so it uses a socket of its own.
+type natTarget struct {
+	sock *natSocket
+	addr netip.AddrPort
+}
+
+// natSocket is an outbound socket of a udpNAT.
+type natSocket struct {
+	conn   net.PacketConn
+	mu     sync.Mutex                   // protects following
+	sent   map[netip.AddrPort]time.Time // when datagrams were last exchanged with an address and port
+	sentIP map[netip.Addr]time.Time     // when datagrams were last exchanged with an address
+}
+
+func newUDPNAT(sess *session, client net.PacketConn) *udpNAT {
+	return &udpNAT{
+		sess:    sess,
+		client:  client,
+		sockets: map[socks5.ContextDialer]*natSocket{},
+		targets: map[socks5.Addr]natTarget{},
+	}
+}
+
+// packetListener returns the PacketListener and local address to use for dialer, or nil if it has none
+// or can't be used as a map key. The local address is the IP address of a *net.Dialer's LocalAddr, if set.
+func packetListener(dialer socks5.ContextDialer) (pl socks5.PacketListener, laddr string) {
+	laddr = ":0"
+	switch d := dialer.(type) {
+	case socks5.PacketListener:
+		pl = d
+	case *net.Dialer:
+		pl = &net.ListenConfig{Control: d.Control}
+		if d.LocalAddr != nil {
+			if ap, err := netip.ParseAddrPort(d.LocalAddr.String()); err == nil {
+				laddr = netip.AddrPortFrom(ap.Addr(), 0).String()
+			}
+		}
+	}
+	if pl != nil && !reflect.TypeOf(dialer).Comparable() {
+		pl = nil
+	}
+	return
+}
+
+// open resolves a new target and returns it with the outbound socket for its dialer,
+// opening the socket if needed. If the RequestFilter resolved the target, addrs are the
+// checked addresses, and the first is used.
+func (nat *udpNAT) open(ctx context.Context, clientaddr net.Addr, addr socks5.Addr, addrs []string) (t natTarget, err error) {
+	var dialer socks5.ContextDialer
+	if dialer, err = nat.sess.selectDialer("udp", addr.String()); err == nil {
+		err = errUDPNATUnsupported
+		if pl, laddr := packetListener(dialer); pl != nil {
+			ctx, cancel := context.WithTimeout(ctx, nat.sess.dialTimeout("udp", addr.String()))
+			defer cancel()
+			nat.sess.emit(Event{Type: EventDialStart, Network: "udp", Address: addr.String()})
+			started := time.Now()
+			if t.addr, err = resolveUDPTarget(ctx, dialer, addr, addrs); err == nil {
+				if t.sock = nat.sockets[dialer]; t.sock == nil {
+					t.sock, err = nat.listen(ctx, clientaddr, dialer, pl, laddr)
+				}
+			}
+			nat.sess.observeDial("udp", started, err)
+			nat.sess.emit(Event{Type: EventDialDone, Network: "udp", Address: addr.String(), Err: err})
+		}
+	}
+	return
+}
+
+// resolveUDPTarget returns the address to send datagrams for addr to, which is the first of addrs
+// if not empty. Otherwise hostnames are resolved using the dialer if it is a socks5.HostLookuper.
+func resolveUDPTarget(ctx context.Context, dialer socks5.ContextDialer, addr socks5.Addr, addrs []string) (target netip.AddrPort, err error) {
+	if len(addrs) == 0 {
+		addrs = []string{addr.String()}
+	}
+	if target, err = netip.ParseAddrPort(addrs[0]); err != nil {
+		hl, ok := dialer.(socks5.HostLookuper)
+		if !ok {
+			hl = net.DefaultResolver
+		}
+		var hosts []string
+		if hosts, err = hl.LookupHost(ctx, addr.Addr); err == nil {
+			err = &net.DNSError{Err: "no such host", Name: addr.Addr, IsNotFound: true}
+			for _, host := range hosts {
+				var ip netip.Addr
+				if ip, err = netip.ParseAddr(host); err == nil {
+					target = netip.AddrPortFrom(ip, addr.Port)
+					break
+				}
+			}
+		}
+	}
+	target = netip.AddrPortFrom(target.Addr().Unmap(), target.Port())
+	return
+}
+
+// listen opens an outbound socket for dialer on laddr using pl.
+func (nat *udpNAT) listen(ctx context.Context, clientaddr net.Addr, dialer socks5.ContextDialer, pl socks5.PacketListener, laddr string) (sock *natSocket, err error) {
+	var conn net.PacketConn
+	if conn, err = pl.ListenPacket(ctx, "udp", laddr); err == nil {
+		_ = nat.sess.Debug && nat.sess.LogDebug("ASSOCIATE NAT", "session", nat.sess.conn.RemoteAddr(), "mode", nat.sess.UDPNAT, "address", conn.LocalAddr())
+		sock = &natSocket{
+			conn:   conn,
+			sent:   map[netip.AddrPort]time.Time{},
+			sentIP: map[netip.Addr]time.Time{},
+		}
+		nat.sockets[dialer] = sock
+		nat.wg.Add(1)
+		go func() {
+			defer nat.wg.Done()
+			nat.serve(sock, clientaddr)
+		}()
+	}
+	return
+}
+
+// send relays a datagram from the client. Datagrams for targets that are denied or
+// can't be resolved are dropped. Returns errUDPNATUnsupported if the dialer for
+// the target can't provide a packet connection.
+func (nat *udpNAT) send(ctx context.Context, clientaddr net.Addr, pkt *socks5.UDPPacket) (err error) {
+	t, ok := nat.targets[pkt.Addr]
+	if !ok {
+		var addrs []string
+		if addrs, ok = nat.sess.allowUDPTarget(ctx, len(nat.targets), pkt.Addr.String()); ok {
+			if t, err = nat.open(ctx, clientaddr, pkt.Addr, addrs); err == nil {
+				nat.targets[pkt.Addr] = t
+			} else if err == errUDPNATUnsupported {
+				_ = nat.sess.Debug && nat.sess.LogDebug("ASSOCIATE NAT not supported by dialer", "session", nat.sess.conn.RemoteAddr(), "address", pkt.Addr)
+				nat.targets[pkt.Addr] = natTarget{}
+			} else {
+				_ = nat.sess.Debug && nat.sess.LogDebug("ASSOCIATE NAT target failed", "session", nat.sess.conn.RemoteAddr(), "address", pkt.Addr, "error", err)
+				nat.sess.denyUDPTarget(pkt.Addr.String())
+				ok, err = false, nil
+			}
+		}
+	}
+	if ok && err == nil && t.sock == nil {
+		err = errUDPNATUnsupported
+	}
+	if ok && err == nil && nat.sess.allowPacket(len(pkt.Body), true) {
+		var nn int
+		if nn, err = t.sock.conn.WriteTo(pkt.Body, net.UDPAddrFromAddrPort(t.addr)); err == nil {
+			if err = socks5.MustEqual(nn, len(pkt.Body), io.ErrShortWrite); err == nil {
+				t.sock.refresh(t.addr)
+				nat.sess.touch()
+				nat.sess.addBytes(nn, true)
+			}
+		}
+	}
+	return
+}
+
+// refresh records that datagrams were exchanged with addr.
+func (sock *natSocket) refresh(addr netip.AddrPort) {
+	now := time.Now()
+	sock.mu.Lock()
+	sock.sent[addr] = now
+	sock.sentIP[addr.Addr()] = now
+	sock.mu.Unlock()
+}
+
+// permitted returns true if a datagram from addr may be relayed to the client.
+func (sock *natSocket) permitted(mode UDPNAT, addr netip.AddrPort) (ok bool) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	switch mode {
+	case UDPNATAddressDependent:
+		_, ok = sock.sentIP[addr.Addr()]
+	case UDPNATAddressAndPortDependent:
+		_, ok = sock.sent[addr]
+	default:
+		ok = true
+	}
+	return
+}
+
+// lastSent returns when datagrams were last exchanged with addr.
+func (sock *natSocket) lastSent(addr netip.AddrPort) time.Time {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	return sock.sent[addr]
+}
+
+// expire forgets addresses that no datagrams have been exchanged with since deadline.
+func (sock *natSocket) expire(deadline time.Time) {
+	sock.mu.Lock()
+	defer sock.mu.Unlock()
+	for addr, when := range sock.sent {
+		if when.Before(deadline) {
+			delete(sock.sent, addr)
+		}
+	}
+	for addr, when := range sock.sentIP {
+		if when.Before(deadline) {
+			delete(sock.sentIP, addr)
+		}
+	}
+}
+
+// expire forgets targets and addresses that no datagrams have been exchanged with for UDPTimeout.
+func (nat *udpNAT) expire() {
+	deadline := time.Now().Add(-UDPTimeout)
+	for k, t := range nat.targets {
+		if t.sock != nil && t.sock.lastSent(t.addr).Before(deadline) {
+			delete(nat.targets, k)
+		}
+	}
+	for _, sock := range nat.sockets {
+		sock.expire(deadline)
+	}
+}
+
+// close closes the outbound sockets and waits for serve to stop.
+func (nat *udpNAT) close() {
+	for _, sock := range nat.sockets {
+		_ = sock.conn.Close()
+	}
+	nat.wg.Wait()
+}
+
+// serve relays datagrams from sock to the client until sock is closed.
+func (nat *udpNAT) serve(sock *natSocket, clientaddr net.Addr) {
+	var buf [maxUdpPacket]byte
+	var err error
+	for err == nil {
+		var n int
+		var srcnetaddr net.Addr
+		if n, srcnetaddr, err = sock.conn.ReadFrom(buf[:]); err == nil {
+			if ua, ok := srcnetaddr.(*net.UDPAddr); ok {
+				src := netip.AddrPortFrom(ua.AddrPort().Addr().Unmap(), ua.AddrPort().Port())
+				if sock.permitted(nat.sess.UDPNAT, src) && nat.sess.allowPacket(n, false) {
+					var b []byte
+					if b, err = (&socks5.UDPPacket{Addr: socks5.AddrFromHostPort(src.Addr().String(), src.Port()), Body: buf[:n]}).MarshalBinary(); err == nil {
+						var nn int
+						if nn, err = nat.client.WriteTo(b, clientaddr); err == nil {
+							if err = socks5.MustEqual(nn, len(b), io.ErrShortWrite); err == nil {
+								if nat.sess.UDPNAT != UDPNATEndpointIndependent {
+									sock.refresh(src)
+								}
+								nat.sess.touch()
+								nat.sess.addBytes(n, false)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	_ = nat.sess.Debug && nat.sess.LogDebug("ASSOCIATE NAT stop", "session", nat.sess.conn.RemoteAddr(), "error", err)
+}
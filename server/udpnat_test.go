@@ -0,0 +1,256 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/server"
+)
+
+// startSTUNServer starts a UDP server that replies with the source address of each datagram.
+func startSTUNServer(t *testing.T) net.PacketConn {
+	t.Helper()
+	return startUDPServer(t, func(b []byte, addr net.Addr) []byte { return []byte(addr.String()) })
+}
+
+// mappedAddr sends a datagram through the relay to the STUN server and returns the address it saw.
+func mappedAddr(t *testing.T, pc net.PacketConn, relay socks5.Addr, stun net.Addr) string {
+	t.Helper()
+	target, err := socks5.AddrFromString(stun.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ua, err := net.ResolveUDPAddr("udp", relay.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := (&socks5.UDPPacket{Addr: target, Body: []byte("stun")}).MarshalBinary()
+	if _, err = pc.WriteTo(b, ua); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := socks5.ParseUDPPacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pkt.Body)
+}
+
+func TestServer_UDPNAT_Mapping(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	stun1 := startSTUNServer(t)
+	stun2 := startSTUNServer(t)
+
+	for _, mode := range []server.UDPNAT{server.UDPNATSymmetric, server.UDPNATEndpointIndependent, server.UDPNATAddressDependent, server.UDPNATAddressAndPortDependent} {
+		t.Run(mode.String(), func(t *testing.T) {
+			listen := startServer(t, ctx, &server.Server{UDPNAT: mode})
+			defer listen.Close()
+
+			_, relay := rawAssociate(t, listen.Addr().String())
+			pc := sendUDPFrom(t, "127.0.0.1:0", relay, stun1.LocalAddr(), "")
+			_ = gotUDP(pc)
+			m1 := mappedAddr(t, pc, relay, stun1.LocalAddr())
+			m2 := mappedAddr(t, pc, relay, stun2.LocalAddr())
+			if same := m1 == m2; same == (mode == server.UDPNATSymmetric) {
+				t.Error(m1, m2)
+			}
+		})
+	}
+}
+
+func TestServer_UDPNAT_Filtering(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	stun := startSTUNServer(t)
+
+	tests := []struct {
+		mode      server.UDPNAT
+		sameIP    bool // relays from the target's IP address and another port
+		otherAddr bool // relays from another IP address
+	}{
+		{server.UDPNATSymmetric, false, false},
+		{server.UDPNATEndpointIndependent, true, true},
+		{server.UDPNATAddressDependent, true, false},
+		{server.UDPNATAddressAndPortDependent, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			listen := startServer(t, ctx, &server.Server{UDPNAT: tt.mode})
+			defer listen.Close()
+
+			_, relay := rawAssociate(t, listen.Addr().String())
+			pc := sendUDPFrom(t, "127.0.0.1:0", relay, stun.LocalAddr(), "")
+			_ = gotUDP(pc)
+
+			for _, laddr := range []string{"127.0.0.1:0", "127.0.0.2:0"} {
+				mapped, err := net.ResolveUDPAddr("udp", mappedAddr(t, pc, relay, stun.LocalAddr()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				other, err := net.ListenPacket("udp", laddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer other.Close()
+				if _, err = other.WriteTo([]byte("unsolicited"), mapped); err != nil {
+					t.Fatal(err)
+				}
+				want := tt.sameIP
+				if laddr != "127.0.0.1:0" {
+					want = tt.otherAddr
+				}
+				if got := gotUDP(pc); got != want {
+					t.Error(laddr, got)
+				}
+			}
+		})
+	}
+}
+
+func TestUDPNAT_String(t *testing.T) {
+	if s := server.UDPNATAddressDependent.String(); s != "address-dependent" {
+		t.Error(s)
+	}
+	if s := server.UDPNAT(9).String(); s != "udpnat(9)" {
+		t.Error(s)
+	}
+}
+
+// portDialerSelector selects the dialer by target port, using the default if there is none.
+type portDialerSelector map[uint16]socks5.ContextDialer
+
+func (pds portDialerSelector) SelectDialer(username, network, address string) (socks5.ContextDialer, error) {
+	_, port, err := socks5.SplitHostPort(address)
+	return pds[port], err
+}
+
+func TestServer_UDPNAT_Dialers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	stun1 := startSTUNServer(t)
+	stun2 := startSTUNServer(t)
+	stun3 := startSTUNServer(t)
+
+	selector := portDialerSelector{
+		uint16(stun2.LocalAddr().(*net.UDPAddr).Port): &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}},
+	}
+	listen := startServer(t, ctx, &server.Server{UDPNAT: server.UDPNATEndpointIndependent, DialerSelector: selector})
+	defer listen.Close()
+
+	_, relay := rawAssociate(t, listen.Addr().String())
+	pc := sendUDPFrom(t, "127.0.0.1:0", relay, stun1.LocalAddr(), "")
+	_ = gotUDP(pc)
+	m1 := mappedAddr(t, pc, relay, stun1.LocalAddr())
+	m2 := mappedAddr(t, pc, relay, stun2.LocalAddr())
+	m3 := mappedAddr(t, pc, relay, stun3.LocalAddr())
+	if m1 != m3 || m1 == m2 {
+		t.Error(m1, m2, m3)
+	}
+	if host, _, _ := net.SplitHostPort(m2); host != "127.0.0.2" {
+		t.Error(m2)
+	}
+}
+
+// streamDialer is a ContextDialer that can't provide packet connections.
+type streamDialer struct{}
+
+func (streamDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return socks5.DefaultDialer.DialContext(ctx, network, address)
+}
+
+func TestServer_UDPNAT_Fallback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	stun1 := startSTUNServer(t)
+	stun2 := startSTUNServer(t)
+	stun3 := startSTUNServer(t)
+
+	selector := portDialerSelector{uint16(stun2.LocalAddr().(*net.UDPAddr).Port): streamDialer{}}
+	listen := startServer(t, ctx, &server.Server{UDPNAT: server.UDPNATEndpointIndependent, DialerSelector: selector})
+	defer listen.Close()
+
+	_, relay := rawAssociate(t, listen.Addr().String())
+	pc := sendUDPFrom(t, "127.0.0.1:0", relay, stun1.LocalAddr(), "")
+	_ = gotUDP(pc)
+	m1 := mappedAddr(t, pc, relay, stun1.LocalAddr())
+	m2 := mappedAddr(t, pc, relay, stun2.LocalAddr())
+	m3 := mappedAddr(t, pc, relay, stun3.LocalAddr())
+	if m1 != m3 || m1 == m2 {
+		t.Error(m1, m2, m3)
+	}
+	if m := mappedAddr(t, pc, relay, stun2.LocalAddr()); m != m2 {
+		t.Error(m, m2)
+	}
+}
+
+// lookupDialer is a ContextDialer and PacketListener resolving hostnames using a staticLookuper.
+type lookupDialer struct {
+	net.Dialer
+	net.ListenConfig
+	staticLookuper
+}
+
+func TestServer_UDPNAT_Resolve(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	stun := startSTUNServer(t)
+	port := uint16(stun.LocalAddr().(*net.UDPAddr).Port)
+
+	reh := &recordingEventHandler{}
+	dialer := &lookupDialer{staticLookuper: staticLookuper{"stun.test": {"127.0.0.1"}}}
+	srv := &server.Server{
+		UDPNAT:         server.UDPNATEndpointIndependent,
+		DialerSelector: portDialerSelector{1: dialer, port: dialer},
+		EventHandler:   reh,
+	}
+	listen := startServer(t, ctx, srv)
+	defer listen.Close()
+
+	conn, relay := rawAssociate(t, listen.Addr().String())
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ua, err := net.ResolveUDPAddr("udp", relay.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// datagrams for unresolvable targets are dropped without ending the association
+	for _, target := range []socks5.Addr{socks5.AddrFromHostPort("bad.test", 1), socks5.AddrFromHostPort("stun.test", port)} {
+		b, _ := (&socks5.UDPPacket{Addr: target, Body: []byte("stun")}).MarshalBinary()
+		if _, err = pc.WriteTo(b, ua); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !gotUDP(pc) {
+		t.Error("no reply")
+	}
+	_ = conn.Close()
+
+	var dials []string
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventDialDone {
+			dials = append(dials, ev.Address+" "+strconv.FormatBool(ev.Err == nil))
+		}
+	}
+	if want := []string{"bad.test:1 false", net.JoinHostPort("stun.test", strconv.Itoa(int(port))) + " true"}; !slices.Equal(dials, want) {
+		t.Errorf("\n got %q\nwant %q", dials, want)
+	}
+}
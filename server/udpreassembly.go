@@ -0,0 +1,59 @@
+package server
+
+import (
+	"time"
+
+	"github.com/linkdata/socks5"
+)
+
+// udpReassembly is the reassembly queue for fragmented UDP datagrams of an ASSOCIATE session (RFC 1928, section 7).
+type udpReassembly struct {
+	addr    socks5.Addr // destination of the queued fragments
+	body    []byte      // payload of the queued fragments
+	last    byte        // position of the last queued fragment, 0 if the queue is empty
+	expires time.Time   // when the reassembly timer expires
+}
+
+// reset discards any queued fragments.
+func (r *udpReassembly) reset() {
+	r.body = r.body[:0]
+	r.last = 0
+}
+
+// expire discards any queued fragments if the reassembly timer has expired.
+func (r *udpReassembly) expire(now time.Time) {
+	if r.last != 0 && now.After(r.expires) {
+		r.reset()
+	}
+}
+
+// add adds pkt to the queue and returns the reassembled datagram once it is complete,
+// or pkt itself if it is not a fragment. Otherwise it returns nil.
+//
+// Fragments must arrive in order. A fragment that does not follow the last one queued,
+// or arrives after the reassembly timer expired, causes the queue to be discarded.
+func (r *udpReassembly) add(pkt *socks5.UDPPacket, now time.Time) (complete *socks5.UDPPacket) {
+	r.expire(now)
+	if pkt.Frag == 0 {
+		r.reset()
+		return pkt
+	}
+	pos := pkt.Frag &^ socks5.UDPFragEnd
+	if pos != r.last+1 || (r.last != 0 && pkt.Addr != r.addr) || len(r.body)+len(pkt.Body) > maxUdpPacket {
+		r.reset()
+	}
+	if pos == r.last+1 {
+		if pos == 1 {
+			r.addr = pkt.Addr
+			r.expires = now.Add(UDPReassemblyTimeout)
+		}
+		r.body = append(r.body, pkt.Body...)
+		r.last = pos
+		if pkt.Frag&socks5.UDPFragEnd != 0 {
+			complete = &socks5.UDPPacket{Addr: r.addr, Body: r.body}
+			r.body = nil
+			r.last = 0
+		}
+	}
+	return
+}
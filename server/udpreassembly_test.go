@@ -0,0 +1,103 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+func dialUDPEcho(t *testing.T, ctx context.Context) (uc *client.UDPConn, target socks5.Addr) {
+	t.Helper()
+	echo := startUDPEchoServer(t)
+	t.Cleanup(func() { echo.Close() })
+	listen := startServer(t, ctx, &server.Server{})
+	t.Cleanup(func() { listen.Close() })
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if target, err = socks5.AddrFromString(echo.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	return conn.(*client.UDPConn), target
+}
+
+func writeFragment(t *testing.T, uc *client.UDPConn, target socks5.Addr, frag byte, body string) {
+	t.Helper()
+	b, err := (&socks5.UDPPacket{Addr: target, Body: []byte(body), Frag: frag}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uc.Conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readEcho(t *testing.T, uc *client.UDPConn) string {
+	t.Helper()
+	buf := make([]byte, 8192)
+	_ = uc.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := uc.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestServer_UDPFragments(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	uc, _ := dialUDPEcho(t, ctx)
+	uc.MaxFragmentSize = 500
+	payload := bytes.Repeat([]byte("0123456789"), 200)
+	if n, err := uc.Write(payload); n != len(payload) || err != nil {
+		t.Fatal(n, err)
+	}
+	if s := readEcho(t, uc); s != string(payload) {
+		t.Error(len(s))
+	}
+
+	uc.MaxFragmentSize = 1
+	if _, err := uc.Write(payload[:socks5.UDPMaxFragments+1]); err != socks5.ErrTooManyFragments {
+		t.Error(err)
+	}
+}
+
+func TestServer_UDPFragments_Discarded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	uc, target := dialUDPEcho(t, ctx)
+
+	// out of order
+	writeFragment(t, uc, target, 2|socks5.UDPFragEnd, "b")
+	writeFragment(t, uc, target, 1, "a")
+	// interrupted by a datagram that is not fragmented
+	writeFragment(t, uc, target, 0, "c")
+	writeFragment(t, uc, target, 2|socks5.UDPFragEnd, "b")
+	if s := readEcho(t, uc); s != "c" {
+		t.Error(s)
+	}
+
+	// reassembly timer expired
+	writeFragment(t, uc, target, 1, "a")
+	time.Sleep(server.UDPReassemblyTimeout * 2)
+	writeFragment(t, uc, target, 2|socks5.UDPFragEnd, "b")
+	writeFragment(t, uc, target, 1, "d")
+	writeFragment(t, uc, target, 2|socks5.UDPFragEnd, "e")
+	if s := readEcho(t, uc); s != "de" {
+		t.Error(s)
+	}
+}
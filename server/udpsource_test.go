@@ -0,0 +1,168 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/linkdata/socks5"
+	"github.com/linkdata/socks5/client"
+	"github.com/linkdata/socks5/server"
+)
+
+// rawAssociate performs an ASSOCIATE request declaring a zero address, returning the relay address.
+func rawAssociate(t *testing.T, proxy string) (conn net.Conn, relay socks5.Addr) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, _ := socks5.ZeroAddr.AppendBinary([]byte{socks5.Socks5Version, 1, byte(socks5.AuthMethodNone), socks5.Socks5Version, byte(socks5.CommandAssociate), 0})
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var hdr [5]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[3] != byte(socks5.ReplySuccess) {
+		t.Fatal(hdr)
+	}
+	if relay, err = socks5.ReadAddr(conn); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// sendUDPFrom sends a datagram for target from a new socket bound to laddr and returns it.
+func sendUDPFrom(t *testing.T, laddr string, relay socks5.Addr, target net.Addr, body string) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	addr, err := socks5.AddrFromString(target.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := (&socks5.UDPPacket{Addr: addr, Body: []byte(body)}).MarshalBinary()
+	ua, err := net.ResolveUDPAddr("udp", relay.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = pc.WriteTo(b, ua); err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func gotUDP(pc net.PacketConn) bool {
+	_ = pc.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, _, err := pc.ReadFrom(make([]byte, 256))
+	return err == nil
+}
+
+func TestServer_UDPSource_Declared(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	reh := &recordingEventHandler{}
+	listen := startServer(t, ctx, &server.Server{EventHandler: reh})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.DeclareUDPAddr = true
+	conn, err := cli.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc := conn.(*client.UDPConn)
+	relay, err := socks5.AddrFromString(uc.Conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another socket on the same IP address races the client
+	if hijacker := sendUDPFrom(t, "127.0.0.1:0", relay, echo.LocalAddr(), "hijack"); gotUDP(hijacker) {
+		t.Error("hijacker got a reply")
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 16)); err != nil {
+		t.Error(err)
+	}
+	_ = conn.Close()
+
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventRequest && ev.Target != uc.Conn.LocalAddr().String() {
+			t.Error(ev.Target, uc.Conn.LocalAddr())
+		}
+	}
+}
+
+func TestServer_UDPSource_Undeclared(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	reh := &recordingEventHandler{}
+	listen := startServer(t, ctx, &server.Server{EventHandler: reh})
+	defer listen.Close()
+
+	cli, err := client.New("socks5h://" + listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := cli.DialContext(ctx, "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 16)); err != nil {
+		t.Error(err)
+	}
+	host, _, _ := net.SplitHostPort(conn.(*client.UDPConn).Conn.LocalAddr().String())
+	_ = conn.Close()
+
+	// only the IP address is declared
+	for _, ev := range reh.closed(ctx) {
+		if ev.Type == server.EventRequest && ev.Target != net.JoinHostPort(host, "0") {
+			t.Error(ev.Target, host)
+		}
+	}
+}
+
+func TestServer_UDPSource_Mismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	echo := startUDPEchoServer(t)
+	defer echo.Close()
+
+	for _, allow := range []bool{false, true} {
+		listen := startServer(t, ctx, &server.Server{AllowUDPSourceMismatch: allow})
+		defer listen.Close()
+
+		_, relay := rawAssociate(t, listen.Addr().String())
+		if got := gotUDP(sendUDPFrom(t, "127.0.0.2:0", relay, echo.LocalAddr(), "hello")); got != allow {
+			t.Error(allow, got)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package socks5
+
+import "fmt"
+
+// Socks4Version is the version byte of SOCKS4 and SOCKS4a requests.
+const Socks4Version = 4
+
+// Socks4ReplyVersion is the version byte of SOCKS4 replies.
+const Socks4ReplyVersion = 0
+
+// Socks4ReplyCode is the reply code in SOCKS4 packets sent from the server to a client.
+type Socks4ReplyCode byte
+
+const (
+	Socks4Granted        Socks4ReplyCode = 90 // request granted
+	Socks4Rejected       Socks4ReplyCode = 91 // request rejected or failed
+	Socks4NoIdentd       Socks4ReplyCode = 92 // rejected because the client identd is unreachable
+	Socks4IdentdMismatch Socks4ReplyCode = 93 // rejected because the client identd reported a different user ID
+)
+
+var socks4ReplyCodeError = map[Socks4ReplyCode]error{
+	Socks4Granted:        nil,
+	Socks4Rejected:       ErrSocks4Rejected,
+	Socks4NoIdentd:       ErrSocks4NoIdentd,
+	Socks4IdentdMismatch: ErrSocks4IdentdMismatch,
+}
+
+func (code Socks4ReplyCode) ToError() error {
+	if err, ok := socks4ReplyCodeError[code]; ok {
+		return err
+	}
+	return fmt.Errorf("socks4code(%v)", code)
+}
@@ -0,0 +1,15 @@
+package socks5
+
+import "testing"
+
+func TestSocks4ReplyCode_ToError(t *testing.T) {
+	for k, v := range socks4ReplyCodeError {
+		if k.ToError() != v {
+			t.Error(k, v)
+		}
+	}
+	code := Socks4ReplyCode(254)
+	if x := code.ToError().Error(); x != "socks4code(254)" {
+		t.Error(x)
+	}
+}
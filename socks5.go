@@ -10,11 +10,16 @@ type AuthMethod byte
 
 const (
 	AuthMethodNone      AuthMethod = 0   // no authentication required (RFC 1928, section 3)
+	AuthGSSAPI          AuthMethod = 1   // GSS-API authentication (RFC 1961)
 	AuthUserPass        AuthMethod = 2   // user/password authentication (RFC 1928, section 3)
+	AuthHMAC            AuthMethod = 128 // HMAC-SHA256 challenge-response (private method)
+	AuthToken           AuthMethod = 129 // signed bearer token (private method)
 	AuthNoAcceptable    AuthMethod = 255 // no acceptable authentication methods (RFC 1928, section 3)
 	AuthSuccess                    = 0   // client auth accepted
 	AuthFailure                    = 1   // client auth denied
 	AuthUserPassVersion            = 1   // auth version byte (RFC 1929).
+	AuthPrivateVersion             = 1   // auth version byte of AuthHMAC and AuthToken
+	HMACChallengeSize              = 32  // size of the AuthHMAC challenge
 )
 
 type CommandType byte
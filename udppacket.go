@@ -4,36 +4,54 @@ import (
 	"bytes"
 )
 
+const (
+	UDPFragEnd      = 0x80 // FRAG bit marking the last fragment of a datagram (RFC 1928, section 7)
+	UDPMaxFragments = 127  // maximum number of fragments of a datagram
+)
+
 type UDPPacket struct {
 	Addr Addr
 	Body []byte
+	Frag byte // fragment number, 0 if not fragmented
 }
 
-func requireValidHeader(data []byte) (err error) {
+func requireValidHeader(data []byte, allowFrag bool) (err error) {
 	if len(data) < 4 || data[0] != 0 || data[1] != 0 {
 		err = ErrInvalidUDPPacket
-	} else if data[2] != 0 {
+	} else if data[2] != 0 && !allowFrag {
 		err = ErrFragmentedUDPPacket
 	}
 	return
 }
 
-func ParseUDPPacket(data []byte) (pkt *UDPPacket, err error) {
-	if err = requireValidHeader(data); err == nil {
+func parseUDPPacket(data []byte, allowFrag bool) (pkt *UDPPacket, err error) {
+	if err = requireValidHeader(data, allowFrag); err == nil {
 		reader := bytes.NewReader(data[3:])
 		var addr Addr
 		if addr, err = ReadAddr(reader); err == nil {
 			pkt = &UDPPacket{
 				Addr: addr,
 				Body: data[len(data)-reader.Len():],
+				Frag: data[2],
 			}
 		}
 	}
 	return
 }
 
+// ParseUDPPacket parses a UDP datagram, returning ErrFragmentedUDPPacket if it is a fragment.
+func ParseUDPPacket(data []byte) (pkt *UDPPacket, err error) {
+	return parseUDPPacket(data, false)
+}
+
+// ParseUDPFragment parses a UDP datagram that may be a fragment.
+// The Body of the returned UDPPacket refers to data.
+func ParseUDPFragment(data []byte) (pkt *UDPPacket, err error) {
+	return parseUDPPacket(data, true)
+}
+
 func (u *UDPPacket) AppendBinary(inbuf []byte) (outbuf []byte, err error) {
-	outbuf = append(inbuf, 0, 0, 0)
+	outbuf = append(inbuf, 0, 0, u.Frag)
 	if outbuf, err = u.Addr.AppendBinary(outbuf); err == nil {
 		outbuf = append(outbuf, u.Body...)
 	}
@@ -44,3 +44,25 @@ func TestUDPPacket_MarshalBinary(t *testing.T) {
 		t.Error(b)
 	}
 }
+
+func TestParseUDPFragment(t *testing.T) {
+	frag := append([]byte{}, normalPacket...)
+	frag[2] = 2 | socks5.UDPFragEnd
+	pkt, err := socks5.ParseUDPFragment(frag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Frag != 2|socks5.UDPFragEnd || !bytes.Equal(pkt.Body, []byte{2}) {
+		t.Error(pkt.Frag, pkt.Body)
+	}
+	b, err := pkt.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, frag) {
+		t.Error(b)
+	}
+	if _, err = socks5.ParseUDPFragment([]byte{0, 1, 1, 0}); err != socks5.ErrInvalidUDPPacket {
+		t.Error(err)
+	}
+}